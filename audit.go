@@ -0,0 +1,163 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// auditSyslog is the audit_log value that writes records to syslog.
+const auditSyslog = "syslog"
+
+const (
+	// outcomeSuccess is the outcome of a decision that allowed access.
+	outcomeSuccess = "success"
+	// outcomeFailure is the outcome of a decision that denied access.
+	outcomeFailure = "failure"
+)
+
+// auditRecord is a single authentication or account management decision.
+//
+// Records only contain information about who is authenticating. Tokens and
+// client secrets are never recorded.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Phase is the PAM phase of the decision, `auth` or `account`.
+	Phase   string `json:"phase"`
+	Service string `json:"service,omitempty"`
+	RHost   string `json:"rhost,omitempty"`
+	RUser   string `json:"ruser,omitempty"`
+	// User is the user being authenticated.
+	User string `json:"user,omitempty"`
+
+	// The following are from the verified token claims, if the token was
+	// verified.
+	Issuer   string   `json:"iss,omitempty"`
+	Subject  string   `json:"sub,omitempty"`
+	Audience []string `json:"aud,omitempty"`
+	JTI      string   `json:"jti,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	ACR      string   `json:"acr,omitempty"`
+
+	// Outcome is outcomeSuccess or outcomeFailure.
+	Outcome string `json:"outcome"`
+	// Reason is the reason for a failure.
+	Reason reasonCode `json:"reason,omitempty"`
+	// Error describes a failure.
+	Error string `json:"error,omitempty"`
+}
+
+// SetClaims records the verified claims, reading groups from the claims at
+// groupsClaimKeys.
+func (r *auditRecord) SetClaims(claims *oidc.Claims, groupsClaimKeys []string) {
+	if claims == nil {
+		return
+	}
+
+	r.Issuer = claims.Issuer
+	r.Subject = claims.Subject
+	r.Audience = claims.Audience
+	r.JTI, _ = claims.Extra["jti"].(string)
+	r.Groups, _ = claimGroups(claims, groupsClaimKeys)
+	r.ACR = claims.ACR
+}
+
+// SetResult records the outcome of the decision, a failure if err is not nil.
+func (r *auditRecord) SetResult(err error) {
+	if err == nil {
+		r.Outcome = outcomeSuccess
+		return
+	}
+
+	r.Outcome = outcomeFailure
+	r.Reason = failureReason(err)
+	r.Error = err.Error()
+}
+
+// auditLog writes audit records as JSON, one per line or syslog message.
+type auditLog struct {
+	w io.WriteCloser
+}
+
+// openAuditLog opens the audit log at dest, which is either auditSyslog or the
+// path to a file to append to.
+func openAuditLog(dest string) (*auditLog, error) {
+	if dest == auditSyslog {
+		w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "pam_oidc")
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %v", err)
+		}
+
+		return &auditLog{w: w}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %v", err)
+	}
+
+	return &auditLog{w: f}, nil
+}
+
+// Write writes rec to the log. Each record is written with a single write, so
+// records from concurrent processes are not interleaved.
+func (l *auditLog) Write(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %v", err)
+	}
+
+	return nil
+}
+
+func (l *auditLog) Close() error {
+	return l.w.Close()
+}
+
+// failurePriority returns the syslog priority for a failure: errors for
+// failures of the module or its configuration, and warnings for failures of
+// the user.
+func failurePriority(err error) syslog.Priority {
+	switch failureReason(err) {
+	case reasonInternal, reasonPAM, reasonConfig, reasonDiscovery, reasonReplayCache:
+		return syslog.LOG_ERR
+	default:
+		return syslog.LOG_WARNING
+	}
+}
+
+// auditDest returns where to write audit records with cfg, or an empty string
+// if they are not written. cfg is nil if the config could not be loaded, in
+// which case the audit log is unknown, so records are written to syslog.
+func auditDest(cfg *config) string {
+	if cfg == nil {
+		return auditSyslog
+	}
+
+	return cfg.AuditLog
+}
+
+// writeAuditRecord writes rec to the audit log at dest.
+func writeAuditRecord(dest string, rec *auditRecord) error {
+	l, err := openAuditLog(dest)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return l.Write(rec)
+}
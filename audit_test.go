@@ -0,0 +1,165 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestAuditRecord(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	issuer := newTestIssuer(t)
+
+	auth, err := discoverAuthenticator(ctx, issuer.provider(), "valid-aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.GroupsClaimKeys = []string{"roles"}
+	auth.AuthorizedGroups = []string{"admins"}
+
+	token := mustJWT(t, issuer.signer, oidc.Claims{
+		Issuer:   issuer.srv.URL,
+		Subject:  "jdoe",
+		Audience: []string{"valid-aud"},
+		Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+		ACR:      "mfa",
+		Extra: map[string]interface{}{
+			"jti":   "abc",
+			"roles": []string{"developers"},
+		},
+	})
+
+	rec := &auditRecord{
+		Time:    now.UTC(),
+		Phase:   "auth",
+		Service: "sshd",
+		RHost:   "192.0.2.1",
+		User:    "jdoe",
+	}
+
+	claims, err := auth.Authenticate(ctx, "jdoe", token)
+	rec.SetClaims(claims, auth.GroupsClaimKeys)
+	rec.SetResult(fmt.Errorf("failed to authenticate: %w", err))
+
+	want := &auditRecord{
+		Time:     now.UTC(),
+		Phase:    "auth",
+		Service:  "sshd",
+		RHost:    "192.0.2.1",
+		User:     "jdoe",
+		Issuer:   issuer.srv.URL,
+		Subject:  "jdoe",
+		Audience: []string{"valid-aud"},
+		JTI:      "abc",
+		Groups:   []string{"developers"},
+		ACR:      "mfa",
+		Outcome:  outcomeFailure,
+		Reason:   reasonGroupDenied,
+		Error:    "failed to authenticate: user is member of [developers], but one of [admins] is required",
+	}
+	if diff := cmp.Diff(want, rec); diff != "" {
+		t.Error(diff)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) {
+		t.Errorf("want token to be omitted, got %s", data)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	cases := []struct {
+		err  error
+		want reasonCode
+	}{
+		{err: authErrorf(reasonUserMismatch, "expected user"), want: reasonUserMismatch},
+		{err: fmt.Errorf("failed to authenticate: %w", authErrorf(reasonACRDenied, "acr")), want: reasonACRDenied},
+		{err: authErrorf(reasonAccountExpired, "%w: at noon", errAccountExpired), want: reasonAccountExpired},
+		{err: fmt.Errorf("failed to authenticate: %v", authErrorf(reasonACRDenied, "acr")), want: reasonInternal},
+		{err: errors.New("unexpected"), want: reasonInternal},
+	}
+
+	for _, tc := range cases {
+		if got := failureReason(tc.err); got != tc.want {
+			t.Errorf("%v: want reason %v, got %v", tc.err, tc.want, got)
+		}
+	}
+
+	if err := authErrorf(reasonAccountExpired, "%w: at noon", errAccountExpired); !errors.Is(err, errAccountExpired) {
+		t.Errorf("want err to wrap %v, got %v", errAccountExpired, err)
+	}
+}
+
+func TestAuditLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, user := range []string{"jdoe", "jane"} {
+		rec := &auditRecord{Phase: "auth", User: user}
+		rec.SetResult(nil)
+		if err := writeAuditRecord(path, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var users []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("want one JSON record per line, got %q: %v", scanner.Text(), err)
+		}
+		if rec.Outcome != outcomeSuccess {
+			t.Errorf("want outcome %v, got %v", outcomeSuccess, rec.Outcome)
+		}
+		users = append(users, rec.User)
+	}
+	if diff := cmp.Diff([]string{"jdoe", "jane"}, users); diff != "" {
+		t.Error(diff)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("want mode 0600, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestAuditDest(t *testing.T) {
+	if dest := auditDest(nil); dest != auditSyslog {
+		t.Errorf("want %s without a config, got %q", auditSyslog, dest)
+	}
+	if dest := auditDest(&config{}); dest != "" {
+		t.Errorf("want no audit log, got %q", dest)
+	}
+	if dest := auditDest(&config{AuditLog: "/var/log/pam_oidc/audit.log"}); dest != "/var/log/pam_oidc/audit.log" {
+		t.Errorf("want configured audit log, got %q", dest)
+	}
+}
@@ -6,31 +6,57 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
+	"net"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/pardot/oidc"
-	"github.com/pardot/oidc/discovery"
-	"golang.org/x/net/http/httpproxy"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// defaultClockSkew is the allowed difference between the clocks of the issuer
+// and this host, matching the leeway allowed for exp and nbf.
+const defaultClockSkew = time.Minute
+
+var (
+	// errAccountExpired is returned by CheckAccount when the token backing the
+	// account has expired.
+	errAccountExpired = errors.New("account expired")
+	// errAccountDisabled is returned by CheckAccount when the account is marked
+	// as disabled by the token claims.
+	errAccountDisabled = errors.New("account disabled")
 )
 
 type authenticator struct {
-	// UserTemplate is a template that, when rendered with the JWT claims, should
-	// match the user being authenticated.
+	// UserTemplates are templates that, when rendered with the JWT claims,
+	// produce candidates for the user being authenticated. The user must match
+	// at least one of the candidates.
 	//
 	// `{{.Subject}}` is used by default if not set.
-	UserTemplate string
+	UserTemplates []string
+
+	// CaseInsensitiveUser compares the user with the candidates rendered from
+	// UserTemplates and listed in UserMap ignoring case.
+	CaseInsensitiveUser bool
 
-	// GroupsClaimKey is the name of the key within the token claims that
-	// specifies which groups a user is a member of.
+	// UserMap, if set, lists the users that tokens may authenticate as. It is
+	// consulted before UserTemplates.
+	UserMap *userMap
+
+	// UserMapOnly only allows the users listed in UserMap, without falling back
+	// to UserTemplates.
+	UserMapOnly bool
+
+	// GroupsClaimKeys are the paths of the claims within the token claims that
+	// specify which groups a user is a member of, such as
+	// `realm_access.roles`. A user is a member of the groups in any of them.
 	//
 	// `groups` is used by default if not set.
-	GroupsClaimKey string
+	GroupsClaimKeys []string
 
 	// AuthorizedGroups is a list of groups required for authentication to pass.
 	// A user must be a member of at least one of the groups in the list, if
@@ -40,111 +66,711 @@ type authenticator struct {
 	// to pass.
 	AuthorizedGroups []string
 
+	// RequiredGroups is a list of groups a user must be a member of all of for
+	// authentication to pass.
+	RequiredGroups []string
+
+	// DeniedGroups is a list of groups whose members are rejected, regardless
+	// of their other groups.
+	//
+	// Each of AuthorizedGroups, RequiredGroups and DeniedGroups may contain
+	// patterns, which are parsed by parseGroupPattern.
+	DeniedGroups []string
+
+	// AllowedNetworks is a list of networks, in CIDR notation, that the
+	// remote host of Request must be in for authentication to pass.
+	AllowedNetworks []string
+
+	// DeniedNetworks is a list of networks that the remote host of Request
+	// must not be in.
+	DeniedNetworks []string
+
+	// GroupNetworks restricts members of groups to networks, parsed by
+	// parseGroupNetwork. A member of a group listed must authenticate from
+	// one of the networks listed for it.
+	GroupNetworks []string
+
+	// GroupHours restricts members of groups to time windows, parsed by
+	// parseTimeWindow. A member of a group listed must authenticate within one
+	// of the windows listed for it.
+	GroupHours []string
+
+	// AccessStartsClaim and AccessExpiresClaim are the paths of claims that
+	// give the time access starts and expires, such as those issued by a
+	// just-in-time access broker. Access is not restricted by a claim that is
+	// absent.
+	AccessStartsClaim  string
+	AccessExpiresClaim string
+
 	// RequireACRs is a list of required values of the acr claim in the token for
 	// authentication to pass. At least one of the acrs must be present if specified
 	//
 	// If the list is empty, the ACR value is not checked.
 	RequireACRs []string
 
-	verifier *oidc.Verifier
-	aud      string
-}
+	// RequireAMRs is a list of values of the amr claim in the token, at least
+	// one of which must be present for authentication to pass.
+	//
+	// If the list is empty, the AMR values are not checked.
+	RequireAMRs []string
 
-func discoverAuthenticator(ctx context.Context, issuer string, aud string, httpProxy string) (*authenticator, error) {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	if httpProxy != "" {
-		// Use no_proxy from environment, if present, but override proxy URL
-		cfg := httpproxy.FromEnvironment()
-		cfg.HTTPProxy = httpProxy
-		cfg.HTTPSProxy = httpProxy
+	// RequireAllAMRs is a list of values of the amr claim in the token, all of
+	// which must be present for authentication to pass.
+	RequireAllAMRs []string
 
-		proxyFunc := cfg.ProxyFunc()
-		transport.Proxy = func(r *http.Request) (*url.URL, error) {
-			return proxyFunc(r.URL)
-		}
+	// RequireClaims is a list of rules that the token claims must all satisfy
+	// for authentication to pass, parsed by parseClaimRule.
+	RequireClaims []string
+
+	// Policy is a CEL expression that must evaluate to true for authentication
+	// to pass, compiled by compilePolicy. It is evaluated with the claims and
+	// Request.
+	Policy string
+	// Request is the PAM context the policy is evaluated in.
+	Request policyRequest
+
+	// DisabledClaimKey is the name of a boolean claim within the token claims
+	// that, when true, marks the account as disabled.
+	//
+	// If empty, the account is never considered disabled. Only checked by
+	// CheckAccount.
+	DisabledClaimKey string
+
+	// Base, if set, is the authorization that must also pass, such as the
+	// global options of a service policy. It is checked first.
+	Base *authenticator
+
+	// MaxTokenAge is the maximum time since the token was issued, based on its
+	// iat claim.
+	//
+	// If zero, the token age is not checked.
+	MaxTokenAge time.Duration
+
+	// MaxAuthAge is the maximum time since the user last authenticated with
+	// the issuer, based on the auth_time claim of the token.
+	//
+	// If zero, the authentication age is not checked.
+	MaxAuthAge time.Duration
+
+	// ClockSkew is the allowed difference between the clocks of the issuer and
+	// this host when checking MaxTokenAge and MaxAuthAge.
+	//
+	// defaultClockSkew is used if nil.
+	ClockSkew *time.Duration
+
+	// ReplayCache, if set, records each authenticated token so that it is only
+	// accepted once.
+	ReplayCache *replayCache
+
+	keys         oidc.KeySource
+	issuer       string
+	introspector *introspector
+	aud          string
+
+	// Logf, if set, logs informational messages about authentication, such as
+	// which user template matched.
+	Logf func(format string, a ...interface{})
+
+	// clock returns the current time. time.Now is used by default.
+	clock func() time.Time
+}
+
+func discoverAuthenticator(ctx context.Context, p *provider, aud string) (*authenticator, error) {
+	if _, err := p.Metadata(ctx); err != nil {
+		return nil, authErrorf(reasonDiscovery, "discovering verifier: %v", err)
 	}
 
-	client, err := discovery.NewClient(ctx, issuer, discovery.WithHTTPClient(&http.Client{
-		Transport: transport,
-	}))
+	return &authenticator{
+		keys:   p,
+		issuer: p.issuer,
+		aud:    aud,
+	}, nil
+}
+
+func discoverIntrospectionAuthenticator(ctx context.Context, p *provider, aud string, clientID string, clientSecret string) (*authenticator, error) {
+	introspector, err := discoverIntrospector(ctx, p)
 	if err != nil {
-		return nil, fmt.Errorf("discovering verifier: %v", err)
+		return nil, err
 	}
+	introspector.ClientID = clientID
+	introspector.ClientSecret = clientSecret
 
-	verifier := oidc.NewVerifier(issuer, client)
 	return &authenticator{
-		verifier: verifier,
-		aud:      aud,
+		introspector: introspector,
+		aud:          aud,
 	}, nil
 }
 
-// Authenticate authenticates a user with the provided token.
-func (a *authenticator) Authenticate(ctx context.Context, user string, token string) error {
-	claims, err := a.verifier.VerifyRaw(ctx, a.aud, token)
+// Authenticate authenticates a user with the provided token, returning the
+// verified claims. If the token is verified, but the user is not authorized,
+// the claims are returned along with the error, so the failure can be audited.
+func (a *authenticator) Authenticate(ctx context.Context, user string, token string) (*oidc.Claims, error) {
+	claims, err := a.verify(ctx, token)
 	if err != nil {
-		return fmt.Errorf("verifying token: %v", err)
+		return nil, err
+	}
+
+	if err := a.checkAge(claims); err != nil {
+		return claims, err
 	}
 
-	userTemplate := "{{.Subject}}"
-	if a.UserTemplate != "" {
-		userTemplate = a.UserTemplate
+	if err := a.checkUser(user, claims); err != nil {
+		return claims, err
 	}
 
-	userTmpl, err := template.New("").Funcs(template.FuncMap{
-		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
-		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
-	}).Parse(userTemplate)
+	if err := a.authorize(claims); err != nil {
+		return claims, err
+	}
+
+	// Only tokens that would otherwise be accepted are recorded, so a token
+	// presented for the wrong user cannot be burned by a third party.
+	if a.ReplayCache != nil {
+		// The token is remembered for as long as verifyJWT would accept it.
+		var expires time.Time
+		if claims.Expiry != 0 {
+			expires = claims.Expiry.Time().Add(jwt.DefaultLeeway)
+		}
+		if err := a.ReplayCache.Use(replayID(claims, token), expires); errors.Is(err, errTokenReplayed) {
+			return claims, authErrorf(reasonTokenReplayed, "%w", err)
+		} else if err != nil {
+			return claims, authErrorf(reasonReplayCache, "%v", err)
+		}
+	}
+
+	return claims, nil
+}
+
+// CheckAccount validates that the account backed by claims, which must have
+// been verified by Authenticate, is still valid: the token has not expired,
+// the account is not disabled, and the group and ACR requirements are met.
+func (a *authenticator) CheckAccount(claims *oidc.Claims) error {
+	clock := time.Now
+	if a.clock != nil {
+		clock = a.clock
+	}
+
+	if claims.Expiry != 0 && !clock().Before(claims.Expiry.Time()) {
+		return authErrorf(reasonAccountExpired, "%w: token expired at %v", errAccountExpired, claims.Expiry.Time().UTC())
+	}
+
+	if a.DisabledClaimKey != "" {
+		if disabled, _ := claims.Extra[a.DisabledClaimKey].(bool); disabled {
+			return authErrorf(reasonAccountDisabled, "%w: claim %q is true", errAccountDisabled, a.DisabledClaimKey)
+		}
+	}
+
+	return a.authorize(claims)
+}
+
+// verify verifies token, either as a signed JWT or with token introspection,
+// returning its claims.
+func (a *authenticator) verify(ctx context.Context, token string) (*oidc.Claims, error) {
+	if a.introspector != nil {
+		claims, err := a.introspector.Introspect(ctx, a.aud, token)
+		if err != nil {
+			return nil, fmt.Errorf("introspecting token: %w", err)
+		}
+
+		return claims, nil
+	}
+
+	claims, err := a.verifyJWT(ctx, token)
 	if err != nil {
-		return fmt.Errorf("parsing user template: %v", err)
+		return nil, fmt.Errorf("verifying token: %w", err)
 	}
 
-	buf := new(bytes.Buffer)
-	if err := userTmpl.Execute(buf, claims); err != nil {
-		return fmt.Errorf("executing user template: %v", err)
+	return claims, nil
+}
+
+// verifyJWT verifies that token is a JWT signed by the issuer for the
+// audience, and is currently valid, returning its claims.
+func (a *authenticator) verifyJWT(ctx context.Context, token string) (*oidc.Claims, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, authErrorf(reasonInvalidToken, "parsing token: %v", err)
+	}
+
+	if len(tok.Headers) != 1 {
+		return nil, authErrorf(reasonInvalidToken, "token must have 1 header, found %d", len(tok.Headers))
+	}
+
+	kid := tok.Headers[0].KeyID
+	if kid == "" {
+		return nil, authErrorf(reasonInvalidToken, "token has no kid header")
+	}
+
+	key, err := a.keys.GetKey(ctx, kid)
+	if err != nil {
+		return nil, fmt.Errorf("fetching key %s: %w", kid, err)
 	}
 
-	wantUser := buf.String()
-	if wantUser != user {
-		return fmt.Errorf("expected user %q but is authenticating as %q", wantUser, user)
+	var jwtClaims jwt.Claims
+	claims := new(oidc.Claims)
+	if err := tok.Claims(key, &jwtClaims, claims); err != nil {
+		return nil, authErrorf(reasonBadSignature, "verifying token signature: %v", err)
+	}
+
+	clock := time.Now
+	if a.clock != nil {
+		clock = a.clock
+	}
+
+	if err := jwtClaims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   a.issuer,
+		Audience: jwt.Audience{a.aud},
+		Time:     clock(),
+	}, jwt.DefaultLeeway); errors.Is(err, jwt.ErrExpired) {
+		return nil, authErrorf(reasonTokenExpired, "claim validation: %v", err)
+	} else if err != nil {
+		return nil, authErrorf(reasonInvalidToken, "claim validation: %v", err)
+	}
+
+	return claims, nil
+}
+
+// checkAge validates that the token was issued, and the user authenticated
+// with the issuer, recently enough to satisfy MaxTokenAge and MaxAuthAge.
+func (a *authenticator) checkAge(claims *oidc.Claims) error {
+	clock := time.Now
+	if a.clock != nil {
+		clock = a.clock
 	}
+	now := clock()
 
-	// Validate AuthorizedGroups / GroupClaimsKey
-	if len(a.AuthorizedGroups) > 0 {
-		groupsClaimKey := "groups"
-		if len(a.GroupsClaimKey) > 0 {
-			groupsClaimKey = a.GroupsClaimKey
+	skew := defaultClockSkew
+	if a.ClockSkew != nil {
+		skew = *a.ClockSkew
+	}
+
+	if a.MaxTokenAge > 0 {
+		if err := checkTimeClaim(now, "iat", claims.IssuedAt, a.MaxTokenAge, skew); err != nil {
+			return err
 		}
+	}
 
-		groupsClaim, ok := claims.Extra[groupsClaimKey].([]interface{})
-		if !ok {
-			return fmt.Errorf("user is not member of any groups, but one of %v is required", a.AuthorizedGroups)
+	if a.MaxAuthAge > 0 {
+		if err := checkTimeClaim(now, "auth_time", claims.AuthTime, a.MaxAuthAge, skew); err != nil {
+			return err
 		}
+	}
 
-		groups := make([]string, 0, len(groupsClaim))
-		for _, groupVal := range groupsClaim {
-			if group, ok := groupVal.(string); ok {
-				groups = append(groups, group)
+	return nil
+}
+
+// checkTimeClaim validates that the time in the claim named name is no more
+// than maxAge before now, and not in the future, allowing for skew.
+func checkTimeClaim(now time.Time, name string, claim oidc.UnixTime, maxAge time.Duration, skew time.Duration) error {
+	if claim == 0 {
+		return authErrorf(reasonTokenTooOld, "token has no %s claim, but a maximum age of %v is required", name, maxAge)
+	}
+
+	t := claim.Time()
+	if t.After(now.Add(skew)) {
+		return authErrorf(reasonTokenTooOld, "token %s claim is %v, which is in the future", name, t.UTC())
+	} else if age := now.Sub(t); age > maxAge+skew {
+		return authErrorf(reasonTokenTooOld, "token %s claim is %v old, but a maximum age of %v is required", name, age.Truncate(time.Second), maxAge)
+	}
+
+	return nil
+}
+
+// checkUser validates that the user being authenticated is listed for the
+// claims in UserMap, or matches one of the candidates rendered from the claims
+// by UserTemplates.
+func (a *authenticator) checkUser(user string, claims *oidc.Claims) error {
+	if a.UserMap != nil {
+		entries, err := a.UserMap.Lookup(claims)
+		if err != nil {
+			return authErrorf(reasonConfig, "%v", err)
+		}
+
+		for _, e := range entries {
+			for _, mapped := range e.users {
+				if a.userMatches(mapped, user) {
+					a.logf("user %q matched user map %s:%d", user, a.UserMap.path, e.line)
+					return nil
+				}
 			}
 		}
-		if !isMemberOfAtLeastOneGroup(a.AuthorizedGroups, groups) {
-			return fmt.Errorf("user is member of %v, but one of %v is required", groups, a.AuthorizedGroups)
+
+		if a.UserMapOnly {
+			return authErrorf(reasonUserMismatch, "user %q is not listed for the token in user map %s", user, a.UserMap.path)
+		}
+	}
+
+	userTemplates := []string{"{{.Subject}}"}
+	if len(a.UserTemplates) > 0 {
+		userTemplates = a.UserTemplates
+	}
+
+	// Parse every template up front, so an invalid template is reported even
+	// if an earlier one matches
+	userTmpls := make([]*template.Template, 0, len(userTemplates))
+	for _, userTemplate := range userTemplates {
+		userTmpl, err := parseClaimsTemplate(userTemplate)
+		if err != nil {
+			return authErrorf(reasonUserTemplate, "parsing user template: %v", err)
+		}
+		userTmpls = append(userTmpls, userTmpl)
+	}
+
+	candidates := make([]string, 0, len(userTemplates))
+	for i, userTmpl := range userTmpls {
+		candidate, err := executeClaimsTemplate(userTmpl, claims)
+		if err != nil {
+			return authErrorf(reasonUserTemplate, "executing user template: %v", err)
+		}
+
+		if a.userMatches(candidate, user) {
+			if len(userTemplates) > 1 {
+				a.logf("user %q matched user template %d (%s)", user, i+1, userTemplates[i])
+			}
+			return nil
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if len(candidates) == 1 {
+		return authErrorf(reasonUserMismatch, "expected user %q but is authenticating as %q", candidates[0], user)
+	}
+	return authErrorf(reasonUserMismatch, "expected user to be one of %q but is authenticating as %q", candidates, user)
+}
+
+// authorize validates that the claims satisfy the group and ACR requirements.
+func (a *authenticator) authorize(claims *oidc.Claims) error {
+	if a.Base != nil {
+		base := *a.Base
+		base.Logf = a.Logf
+		base.clock = a.clock
+		if err := base.authorize(claims); err != nil {
+			return err
 		}
 	}
 
+	if err := a.authorizeGroups(claims); err != nil {
+		return err
+	}
+
+	if err := a.authorizeNetworks(claims); err != nil {
+		return err
+	}
+
+	if err := a.authorizeTime(claims); err != nil {
+		return err
+	}
+
 	// Validate RequireACRs
 	if len(a.RequireACRs) > 0 {
 		if !isACRPresent(a.RequireACRs, claims.ACR) {
-			return fmt.Errorf("acr is %q, but one of %v is required", claims.ACR, a.RequireACRs)
+			return authErrorf(reasonACRDenied, "acr is %q, but one of %v is required", claims.ACR, a.RequireACRs)
+		}
+	}
+
+	// Validate RequireAMRs / RequireAllAMRs
+	if len(a.RequireAMRs) > 0 && !isAMRPresent(a.RequireAMRs, claims.AMR) {
+		return authErrorf(reasonAMRDenied, "amr is %v, but one of %v is required", claims.AMR, a.RequireAMRs)
+	}
+	for _, wantAMR := range a.RequireAllAMRs {
+		if !isAMRPresent([]string{wantAMR}, claims.AMR) {
+			return authErrorf(reasonAMRDenied, "amr is %v, but all of %v are required, including %q", claims.AMR, a.RequireAllAMRs, wantAMR)
+		}
+	}
+
+	if err := a.checkClaims(claims); err != nil {
+		return err
+	}
+
+	return a.checkPolicy(claims)
+}
+
+// checkPolicy validates that Policy allows the claims and Request.
+func (a *authenticator) checkPolicy(claims *oidc.Claims) error {
+	if a.Policy == "" {
+		return nil
+	}
+
+	prg, err := compilePolicy(a.Policy)
+	if err != nil {
+		return authErrorf(reasonConfig, "%v", err)
+	}
+
+	m, err := claimsMap(claims)
+	if err != nil {
+		return fmt.Errorf("reading claims: %v", err)
+	}
+
+	return evalPolicy(prg, m, a.Request)
+}
+
+// checkClaims validates that the claims satisfy each of RequireClaims.
+func (a *authenticator) checkClaims(claims *oidc.Claims) error {
+	if len(a.RequireClaims) == 0 {
+		return nil
+	}
+
+	rules := make([]*claimRule, 0, len(a.RequireClaims))
+	for _, text := range a.RequireClaims {
+		rule, err := parseClaimRule(text)
+		if err != nil {
+			return authErrorf(reasonConfig, "%v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	m, err := claimsMap(claims)
+	if err != nil {
+		return fmt.Errorf("reading claims: %v", err)
+	}
+
+	for _, rule := range rules {
+		if err := rule.Check(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeGroups validates that the claims satisfy AuthorizedGroups,
+// RequiredGroups and DeniedGroups.
+func (a *authenticator) authorizeGroups(claims *oidc.Claims) error {
+	if len(a.AuthorizedGroups) == 0 && len(a.RequiredGroups) == 0 && len(a.DeniedGroups) == 0 {
+		return nil
+	}
+
+	authorized, err := parseGroupPatterns(a.AuthorizedGroups)
+	if err != nil {
+		return authErrorf(reasonConfig, "authorized groups: %v", err)
+	}
+	required, err := parseGroupPatterns(a.RequiredGroups)
+	if err != nil {
+		return authErrorf(reasonConfig, "required groups: %v", err)
+	}
+	denied, err := parseGroupPatterns(a.DeniedGroups)
+	if err != nil {
+		return authErrorf(reasonConfig, "denied groups: %v", err)
+	}
+
+	groups, ok := claimGroups(claims, a.GroupsClaimKeys)
+	if !ok {
+		// A user that is not a member of any groups cannot be a member of a
+		// denied group
+		if len(a.AuthorizedGroups) > 0 {
+			return authErrorf(reasonGroupDenied, "user is not member of any groups, but one of %v is required", a.AuthorizedGroups)
+		} else if len(a.RequiredGroups) > 0 {
+			return authErrorf(reasonGroupDenied, "user is not member of any groups, but all of %v are required", a.RequiredGroups)
+		}
+		return nil
+	}
+
+	// Validate DeniedGroups first, so that a denied member is always
+	// reported as such
+	if matched := matchingGroups(denied, groups); len(matched) > 0 {
+		return authErrorf(reasonGroupDenied, "user is member of %v, which are denied by %v", matched, a.DeniedGroups)
+	}
+
+	if len(authorized) > 0 && !isMemberOfAtLeastOneGroup(authorized, groups) {
+		return authErrorf(reasonGroupDenied, "user is member of %v, but one of %v is required", groups, a.AuthorizedGroups)
+	}
+
+	for i, p := range required {
+		if !p.matchesAnyGroup(groups) {
+			return authErrorf(reasonGroupDenied, "user is member of %v, but all of %v are required, including %q", groups, a.RequiredGroups, a.RequiredGroups[i])
+		}
+	}
+
+	return nil
+}
+
+// authorizeNetworks validates that the remote host of Request satisfies
+// AllowedNetworks, DeniedNetworks and GroupNetworks.
+func (a *authenticator) authorizeNetworks(claims *oidc.Claims) error {
+	if len(a.AllowedNetworks) == 0 && len(a.DeniedNetworks) == 0 && len(a.GroupNetworks) == 0 {
+		return nil
+	}
+
+	allowed, err := parseNetworks(a.AllowedNetworks)
+	if err != nil {
+		return authErrorf(reasonConfig, "allowed networks: %v", err)
+	}
+	denied, err := parseNetworks(a.DeniedNetworks)
+	if err != nil {
+		return authErrorf(reasonConfig, "denied networks: %v", err)
+	}
+	groupNetworks, err := parseGroupNetworks(a.GroupNetworks)
+	if err != nil {
+		return authErrorf(reasonConfig, "group networks: %v", err)
+	}
+
+	rhost := a.Request.RHost
+	ip := parseRemoteHost(rhost)
+	// unknownHost returns the error for a remote host that cannot be shown to
+	// be in the networks required.
+	unknownHost := func() error {
+		if rhost == "" {
+			return authErrorf(reasonNetworkDenied, "remote host is not set, but network restrictions apply")
+		}
+		return authErrorf(reasonNetworkDenied, "remote host %q is not an IP address, but network restrictions apply", rhost)
+	}
+
+	// Local logins have no remote host, so cannot be from a denied network,
+	// but a host name might be
+	if len(denied) > 0 {
+		if ip == nil && rhost != "" {
+			return unknownHost()
+		} else if ip != nil && inNetworks(ip, denied) {
+			return authErrorf(reasonNetworkDenied, "remote host %s is in denied networks %v", rhost, a.DeniedNetworks)
+		}
+	}
+
+	if len(allowed) > 0 {
+		if ip == nil {
+			return unknownHost()
+		} else if !inNetworks(ip, allowed) {
+			return authErrorf(reasonNetworkDenied, "remote host %s is not in allowed networks %v", rhost, a.AllowedNetworks)
+		}
+	}
+
+	if len(groupNetworks) == 0 {
+		return nil
+	}
+
+	groups, _ := claimGroups(claims, a.GroupsClaimKeys)
+	restricted := restrictedGroups(len(groupNetworks), func(i int) groupRestriction {
+		return groupNetworks[i].groupRestriction
+	}, groups)
+	for _, rg := range restricted {
+		var networks []*net.IPNet
+		for _, i := range rg.indexes {
+			networks = append(networks, groupNetworks[i].network)
+		}
+
+		if ip == nil {
+			return unknownHost()
+		} else if !inNetworks(ip, networks) {
+			return authErrorf(reasonNetworkDenied, "remote host %s is not in networks %v of group %q", rhost, networks, rg.group)
 		}
 	}
 
 	return nil
 }
 
-func isMemberOfAtLeastOneGroup(authorizedGroups []string, groups []string) bool {
+// authorizeTime validates that the current time is within GroupHours and the
+// access window of the claims.
+func (a *authenticator) authorizeTime(claims *oidc.Claims) error {
+	if len(a.GroupHours) == 0 && a.AccessStartsClaim == "" && a.AccessExpiresClaim == "" {
+		return nil
+	}
+
+	windows, err := parseTimeWindows(a.GroupHours)
+	if err != nil {
+		return authErrorf(reasonConfig, "group hours: %v", err)
+	}
+
+	clock := time.Now
+	if a.clock != nil {
+		clock = a.clock
+	}
+	now := clock()
+
+	m, err := claimsMap(claims)
+	if err != nil {
+		return fmt.Errorf("reading claims: %v", err)
+	}
+
+	if a.AccessStartsClaim != "" {
+		if v := findClaim(m, a.AccessStartsClaim); v != nil {
+			starts, ok := claimTime(v)
+			if !ok {
+				return authErrorf(reasonTimeDenied, "claim %s is %s, which is not a time", a.AccessStartsClaim, formatClaim(v))
+			} else if now.Before(starts) {
+				return authErrorf(reasonTimeDenied, "access starts at %v", starts.UTC())
+			}
+		}
+	}
+	if a.AccessExpiresClaim != "" {
+		if v := findClaim(m, a.AccessExpiresClaim); v != nil {
+			expires, ok := claimTime(v)
+			if !ok {
+				return authErrorf(reasonTimeDenied, "claim %s is %s, which is not a time", a.AccessExpiresClaim, formatClaim(v))
+			} else if !now.Before(expires) {
+				return authErrorf(reasonTimeDenied, "%w: access expired at %v", errAccountExpired, expires.UTC())
+			}
+		}
+	}
+
+	if len(windows) == 0 {
+		return nil
+	}
+
+	groups, _ := claimGroups(claims, a.GroupsClaimKeys)
+	restricted := restrictedGroups(len(windows), func(i int) groupRestriction {
+		return windows[i].groupRestriction
+	}, groups)
+	for _, rg := range restricted {
+		var texts []string
+		allowed := false
+		for _, i := range rg.indexes {
+			texts = append(texts, windows[i].text)
+			allowed = allowed || windows[i].Contains(now)
+		}
+
+		if !allowed {
+			return authErrorf(reasonTimeDenied, "it is %s, which is not within hours %v of group %q", now.Format("Mon 15:04 MST"), texts, rg.group)
+		}
+	}
+
+	return nil
+}
+
+// userMatches reports whether user matches the non-empty candidate.
+func (a *authenticator) userMatches(candidate string, user string) bool {
+	if candidate == "" {
+		return false
+	} else if a.CaseInsensitiveUser {
+		return strings.EqualFold(candidate, user)
+	}
+
+	return candidate == user
+}
+
+// logf logs an informational message with Logf, if set.
+func (a *authenticator) logf(format string, v ...interface{}) {
+	if a.Logf != nil {
+		a.Logf(format, v...)
+	}
+}
+
+// peekIssuer returns the iss claim of token without verifying it, so the
+// issuer that must verify it can be selected.
+func peekIssuer(token string) (string, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", authErrorf(reasonInvalidToken, "parsing token: %v", err)
+	}
+
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", authErrorf(reasonInvalidToken, "parsing token claims: %v", err)
+	}
+
+	return claims.Issuer, nil
+}
+
+func isMemberOfAtLeastOneGroup(authorizedGroups []groupPattern, groups []string) bool {
 	for _, wantGroup := range authorizedGroups {
-		for _, group := range groups {
-			if wantGroup == group {
+		if wantGroup.matchesAnyGroup(groups) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAMRPresent(authorizedAMRs []string, amrs []string) bool {
+	for _, wantAMR := range authorizedAMRs {
+		for _, amr := range amrs {
+			if wantAMR == amr {
 				return true
 			}
 		}
@@ -11,6 +11,7 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -46,10 +47,15 @@ func TestAuthenticate(t *testing.T) {
 		name             string
 		user             string
 		token            string
-		userTemplate     string
-		groupsClaimKey   string
+		userTemplates    []string
+		groupsClaimKeys  []string
 		authorizedGroups []string
 		requireACRs      []string
+		requireAMRs      []string
+		requireAllAMRs   []string
+		maxTokenAge      time.Duration
+		maxAuthAge       time.Duration
+		clockSkew        *time.Duration
 		wantErr          string
 	}{
 		{
@@ -76,8 +82,8 @@ func TestAuthenticate(t *testing.T) {
 				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
 				IssuedAt:  oidc.UnixTime(now.Unix()),
 			}),
-			userTemplate: "{{.Subject}}:{{index .Audience 0}}",
-			wantErr:      "",
+			userTemplates: []string{"{{.Subject}}:{{index .Audience 0}}"},
+			wantErr:       "",
 		},
 		{
 			name: "valid user, valid token, member of authorized group",
@@ -93,7 +99,7 @@ func TestAuthenticate(t *testing.T) {
 					"roles": []string{"group-a", "group-b"},
 				},
 			}),
-			groupsClaimKey:   "roles",
+			groupsClaimKeys:  []string{"roles"},
 			authorizedGroups: []string{"group-a"},
 			wantErr:          "",
 		},
@@ -111,7 +117,7 @@ func TestAuthenticate(t *testing.T) {
 					"roles": []string{"group-a", "group-b"},
 				},
 			}),
-			groupsClaimKey:   "roles",
+			groupsClaimKeys:  []string{"roles"},
 			authorizedGroups: []string{"group-c", "group-d"},
 			wantErr:          "user is member of [group-a group-b], but one of [group-c group-d] is required",
 		},
@@ -126,13 +132,32 @@ func TestAuthenticate(t *testing.T) {
 				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
 				IssuedAt:  oidc.UnixTime(now.Unix()),
 				Extra: map[string]interface{}{
-					"roles": "not a list",
+					"roles": map[string]interface{}{"not": "a list"},
 				},
 			}),
-			groupsClaimKey:   "roles",
+			groupsClaimKeys:  []string{"roles"},
 			authorizedGroups: []string{"group-c", "group-d"},
 			wantErr:          "user is not member of any groups, but one of [group-c group-d] is required",
 		},
+		{
+			name: "valid user, valid token, nested string groups claim",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+				Extra: map[string]interface{}{
+					"realm_access": map[string]interface{}{
+						"roles": "group-a group-d",
+					},
+				},
+			}),
+			groupsClaimKeys:  []string{"realm_access.roles"},
+			authorizedGroups: []string{"group-c", "group-d"},
+		},
 		{
 			name: "valid user, valid token, matching required ACR",
 			user: "jdoe",
@@ -202,6 +227,86 @@ func TestAuthenticate(t *testing.T) {
 			requireACRs: []string{"foo", "bar", "biz"},
 			wantErr:     "acr is \"foo2\", but one of [foo bar biz] is required",
 		},
+		{
+			name: "valid user, valid token, matching one of required AMRs",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+				Extra: map[string]interface{}{
+					"amr": []string{"pwd", "mfa"},
+				},
+			}),
+			requireAMRs: []string{"mfa", "hwk"},
+		},
+		{
+			name: "valid user, valid token, not matching one of required AMRs",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+				Extra: map[string]interface{}{
+					"amr": []string{"pwd"},
+				},
+			}),
+			requireAMRs: []string{"mfa", "hwk"},
+			wantErr:     "amr is [pwd], but one of [mfa hwk] is required",
+		},
+		{
+			name: "valid user, valid token, missing AMR claim",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+			}),
+			requireAMRs: []string{"mfa"},
+			wantErr:     "amr is [], but one of [mfa] is required",
+		},
+		{
+			name: "valid user, valid token, matching all required AMRs",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+				Extra: map[string]interface{}{
+					"amr": []string{"pwd", "otp", "mfa"},
+				},
+			}),
+			requireAllAMRs: []string{"pwd", "otp"},
+		},
+		{
+			name: "valid user, valid token, not matching all required AMRs",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:    "https://example.com",
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+				Extra: map[string]interface{}{
+					"amr": []string{"pwd", "mfa"},
+				},
+			}),
+			requireAllAMRs: []string{"pwd", "hwk"},
+			wantErr:        `amr is [pwd mfa], but all of [pwd hwk] are required, including "hwk"`,
+		},
 
 		{
 			name: "valid user, valid token, invalid custom user template",
@@ -214,8 +319,8 @@ func TestAuthenticate(t *testing.T) {
 				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
 				IssuedAt:  oidc.UnixTime(now.Unix()),
 			}),
-			userTemplate: "{{broken}}",
-			wantErr:      "parsing user template",
+			userTemplates: []string{"{{broken}}"},
+			wantErr:       "parsing user template",
 		},
 		{
 			name: "invalid user, valid token",
@@ -256,6 +361,100 @@ func TestAuthenticate(t *testing.T) {
 			}),
 			wantErr: "invalid audience claim",
 		},
+		{
+			name: "recent token and authentication",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				IssuedAt: oidc.UnixTime(now.Add(-2 * time.Minute).Unix()),
+				AuthTime: oidc.UnixTime(now.Add(-4 * time.Minute).Unix()),
+			}),
+			maxTokenAge: 5 * time.Minute,
+			maxAuthAge:  5 * time.Minute,
+		},
+		{
+			name: "token too old",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				IssuedAt: oidc.UnixTime(now.Add(-50 * time.Minute).Unix()),
+			}),
+			maxTokenAge: 5 * time.Minute,
+			wantErr:     "token iat claim is 50m0s old, but a maximum age of 5m0s is required",
+		},
+		{
+			name: "authentication too old",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				IssuedAt: oidc.UnixTime(now.Unix()),
+				AuthTime: oidc.UnixTime(now.Add(-8 * time.Hour).Unix()),
+			}),
+			maxAuthAge: time.Hour,
+			wantErr:    "token auth_time claim is 8h0m0s old, but a maximum age of 1h0m0s is required",
+		},
+		{
+			name: "authentication age within clock skew",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				AuthTime: oidc.UnixTime(now.Add(-7 * time.Minute).Unix()),
+			}),
+			maxAuthAge: 5 * time.Minute,
+			clockSkew:  durationPtr(3 * time.Minute),
+		},
+		{
+			name: "authentication age without clock skew",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				AuthTime: oidc.UnixTime(now.Add(-5*time.Minute - 30*time.Second).Unix()),
+			}),
+			maxAuthAge: 5 * time.Minute,
+			clockSkew:  durationPtr(0),
+			wantErr:    "token auth_time claim is 5m30s old, but a maximum age of 5m0s is required",
+		},
+		{
+			name: "authentication in the future",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				AuthTime: oidc.UnixTime(now.Add(5 * time.Minute).Unix()),
+			}),
+			maxAuthAge: 5 * time.Minute,
+			wantErr:    "token auth_time claim is",
+		},
+		{
+			name: "missing auth_time",
+			user: "jdoe",
+			token: mustJWT(t, signer, oidc.Claims{
+				Issuer:   "https://example.com",
+				Subject:  "jdoe",
+				Audience: []string{"valid-aud"},
+				Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				IssuedAt: oidc.UnixTime(now.Unix()),
+			}),
+			maxAuthAge: 5 * time.Minute,
+			wantErr:    "token has no auth_time claim",
+		},
 	}
 
 	for _, tc := range cases {
@@ -263,17 +462,23 @@ func TestAuthenticate(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			ctx := context.Background()
 
-			verifier := oidc.NewVerifier("https://example.com", oidc.NewStaticKeysource(jose.JSONWebKeySet{Keys: verificationKeys}))
 			auth := &authenticator{
-				verifier: verifier,
-				aud:      "valid-aud",
+				keys:   oidc.NewStaticKeysource(jose.JSONWebKeySet{Keys: verificationKeys}),
+				issuer: "https://example.com",
+				aud:    "valid-aud",
+				clock:  func() time.Time { return now },
 			}
-			auth.UserTemplate = tc.userTemplate
-			auth.GroupsClaimKey = tc.groupsClaimKey
+			auth.UserTemplates = tc.userTemplates
+			auth.GroupsClaimKeys = tc.groupsClaimKeys
 			auth.AuthorizedGroups = tc.authorizedGroups
 			auth.RequireACRs = tc.requireACRs
+			auth.RequireAMRs = tc.requireAMRs
+			auth.RequireAllAMRs = tc.requireAllAMRs
+			auth.MaxTokenAge = tc.maxTokenAge
+			auth.MaxAuthAge = tc.maxAuthAge
+			auth.ClockSkew = tc.clockSkew
 
-			err := auth.Authenticate(ctx, tc.user, tc.token)
+			_, err := auth.Authenticate(ctx, tc.user, tc.token)
 			if err != nil && tc.wantErr == "" {
 				t.Errorf("want no err, got %v", err)
 			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
@@ -285,6 +490,143 @@ func TestAuthenticate(t *testing.T) {
 	}
 }
 
+func TestCheckAccount(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name             string
+		claims           *oidc.Claims
+		authorizedGroups []string
+		deniedGroups     []string
+		disabledClaimKey string
+		wantErr          string
+	}{
+		{
+			name: "valid account",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+			},
+		},
+		{
+			name: "expired token",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(-1 * time.Minute).Unix()),
+			},
+			wantErr: "account expired",
+		},
+		{
+			name: "member of authorized group",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"group-a"},
+				},
+			},
+			authorizedGroups: []string{"group-a"},
+		},
+		{
+			name: "not member of authorized group",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"group-b"},
+				},
+			},
+			authorizedGroups: []string{"group-a"},
+			wantErr:          "user is member of [group-b], but one of [group-a] is required",
+		},
+		{
+			name: "member of denied group",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"group-a", "contractors"},
+				},
+			},
+			authorizedGroups: []string{"group-a"},
+			deniedGroups:     []string{"contractors"},
+			wantErr:          "user is member of [contractors], which are denied by [contractors]",
+		},
+		{
+			name: "disabled claim false",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				Extra: map[string]interface{}{
+					"disabled": false,
+				},
+			},
+			disabledClaimKey: "disabled",
+		},
+		{
+			name: "disabled claim true",
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Expiry:  oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				Extra: map[string]interface{}{
+					"disabled": true,
+				},
+			},
+			disabledClaimKey: "disabled",
+			wantErr:          "account disabled",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &authenticator{
+				clock: func() time.Time { return now },
+			}
+			auth.AuthorizedGroups = tc.authorizedGroups
+			auth.DeniedGroups = tc.deniedGroups
+			auth.DisabledClaimKey = tc.disabledClaimKey
+
+			err := auth.CheckAccount(tc.claims)
+			if err != nil && tc.wantErr == "" {
+				t.Errorf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Errorf("want err %v, got none", tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPeekIssuer(t *testing.T) {
+	signer := signer.NewStatic(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key: jose.JSONWebKey{
+			Key:       testKey,
+			KeyID:     "test-key",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		},
+	}, nil)
+
+	token := mustJWT(t, signer, oidc.Claims{
+		Issuer:  "https://example.com",
+		Subject: "jdoe",
+	})
+
+	issuer, err := peekIssuer(token)
+	if err != nil {
+		t.Fatal(err)
+	} else if issuer != "https://example.com" {
+		t.Errorf("want issuer https://example.com, got %q", issuer)
+	}
+
+	if _, err := peekIssuer("not-a-jwt"); err == nil {
+		t.Error("want err for malformed token, got none")
+	}
+}
+
 func mustJWT(t *testing.T, signer *signer.StaticSigner, claims oidc.Claims) string {
 	data, err := json.Marshal(claims)
 	if err != nil {
@@ -340,3 +682,98 @@ E2qpAoGAZo5Wwwk7q8b1n9n/ACh4LpE+QgbFdlJxlfFLJCKstl37atzS8UewOSZj
 FDWV28nTP9sqbtsmU8Tem2jzMvZ7C/Q0AuDoKELFUpux8shm8wfIhyaPnXUGZoAZ
 Np4vUwMSYV5mopESLWOg3loBxKyLGFtgGKVCjGiQvy6zISQ4fQo=
 -----END RSA PRIVATE KEY-----`)
+
+func TestCheckUser(t *testing.T) {
+	claims := &oidc.Claims{
+		Subject: "00u1abcd",
+		Extra: map[string]interface{}{
+			"email":              "Jane.Doe@example.com",
+			"preferred_username": "jdoe",
+		},
+	}
+
+	cases := []struct {
+		name                string
+		user                string
+		userTemplates       []string
+		caseInsensitiveUser bool
+		wantLog             string
+		wantErr             string
+	}{
+		{
+			name:          "default template",
+			user:          "00u1abcd",
+			userTemplates: nil,
+		},
+		{
+			name:          "first candidate",
+			user:          "jdoe",
+			userTemplates: []string{"{{.Extra.preferred_username}}", "{{.Extra.email}}"},
+			wantLog:       `user "jdoe" matched user template 1 ({{.Extra.preferred_username}})`,
+		},
+		{
+			name:          "second candidate",
+			user:          "Jane.Doe@example.com",
+			userTemplates: []string{"{{.Extra.preferred_username}}", "{{.Extra.email}}"},
+			wantLog:       `user "Jane.Doe@example.com" matched user template 2 ({{.Extra.email}})`,
+		},
+		{
+			name:          "case sensitive",
+			user:          "jane.doe@example.com",
+			userTemplates: []string{"{{.Extra.preferred_username}}", "{{.Extra.email}}"},
+			wantErr:       `expected user to be one of ["jdoe" "Jane.Doe@example.com"] but is authenticating as "jane.doe@example.com"`,
+		},
+		{
+			name:                "case insensitive",
+			user:                "jane.doe@example.com",
+			userTemplates:       []string{"{{.Extra.preferred_username}}", "{{.Extra.email}}"},
+			caseInsensitiveUser: true,
+			wantLog:             `user "jane.doe@example.com" matched user template 2 ({{.Extra.email}})`,
+		},
+		{
+			name:          "empty candidate never matches",
+			user:          "jdoe",
+			userTemplates: []string{`{{claim "username"}}`, "{{.Extra.preferred_username}}"},
+			wantLog:       `user "jdoe" matched user template 2 ({{.Extra.preferred_username}})`,
+		},
+		{
+			name:          "invalid template",
+			user:          "jdoe",
+			userTemplates: []string{"{{.Extra.preferred_username}}", "{{broken}}"},
+			wantErr:       "parsing user template",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var logs []string
+			auth := &authenticator{
+				UserTemplates:       tc.userTemplates,
+				CaseInsensitiveUser: tc.caseInsensitiveUser,
+				Logf: func(format string, a ...interface{}) {
+					logs = append(logs, fmt.Sprintf(format, a...))
+				},
+			}
+
+			err := auth.checkUser(tc.user, claims)
+			if err != nil && tc.wantErr == "" {
+				t.Errorf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Errorf("want err %v, got none", tc.wantErr)
+			}
+
+			if tc.wantLog != "" && (len(logs) != 1 || logs[0] != tc.wantLog) {
+				t.Errorf("want log %q, got %q", tc.wantLog, logs)
+			} else if tc.wantLog == "" && len(logs) != 0 {
+				t.Errorf("want no logs, got %q", logs)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
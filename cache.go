@@ -0,0 +1,182 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultCacheTTL is how long responses without a Cache-Control max-age
+	// are considered fresh.
+	defaultCacheTTL = 1 * time.Hour
+
+	// maxCacheStale is how long after expiry a cached response may still be
+	// used when the issuer cannot be reached.
+	maxCacheStale = 24 * time.Hour
+)
+
+// fileCache persists HTTP responses from the issuer, such as discovery
+// documents and JWKS, in a directory so they are shared across processes.
+//
+// Because cached signing keys are trusted, the directory and its files must be
+// owned by the current user or root, and must not be writable by others.
+type fileCache struct {
+	dir string
+}
+
+// cacheEntry is a cached response body.
+type cacheEntry struct {
+	Data    json.RawMessage `json:"data"`
+	Expires time.Time       `json:"expires"`
+}
+
+func newFileCache(dir string) (*fileCache, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening cache directory: %v", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("cache directory %s is not a directory", dir)
+	}
+
+	if err := checkOwnership(dir, fi); err != nil {
+		return nil, err
+	}
+
+	return &fileCache{dir: dir}, nil
+}
+
+// Get returns the cached entry for url, or nil if there is none.
+func (c *fileCache) Get(url string) (*cacheEntry, error) {
+	path := c.path(url)
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening cache entry: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("opening cache entry: %v", err)
+	} else if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("cache entry %s is not a regular file", path)
+	}
+	if err := checkOwnership(path, fi); err != nil {
+		return nil, err
+	}
+
+	entry := new(cacheEntry)
+	if err := json.NewDecoder(f).Decode(entry); err != nil {
+		return nil, fmt.Errorf("decoding cache entry %s: %v", path, err)
+	}
+
+	return entry, nil
+}
+
+// Put atomically replaces the cached entry for url.
+func (c *fileCache) Put(url string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.path(url), data); err != nil {
+		return fmt.Errorf("writing cache entry: %v", err)
+	}
+
+	return nil
+}
+
+func (c *fileCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// writeFileAtomic replaces the file at path with data, so readers see either
+// the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkOwnership validates that path is owned by the current user or root, and
+// is not writable by group or others.
+func checkOwnership(path string, fi os.FileInfo) error {
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s must not be writable by group or others", path)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if uid := int(st.Uid); uid != 0 && uid != os.Geteuid() {
+			return fmt.Errorf("%s must be owned by root or the current user", path)
+		}
+	}
+
+	return nil
+}
+
+// cacheExpiry returns when a response received at now expires, honoring the
+// Cache-Control max-age directive. If the response must not be stored, ok is
+// false.
+func cacheExpiry(header http.Header, now time.Time) (expires time.Time, ok bool) {
+	ttl := defaultCacheTTL
+	noCache := false
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+
+		switch strings.ToLower(name) {
+		case "no-store":
+			return time.Time{}, false
+		case "no-cache":
+			noCache = true
+		case "max-age":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if noCache {
+		ttl = 0
+	}
+
+	return now.Add(ttl), true
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestProviderCache(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name         string
+		cacheControl string
+		// elapsed is the time between the first and second authentication.
+		elapsed time.Duration
+		// unavailable makes the issuer unavailable for the second
+		// authentication.
+		unavailable  bool
+		wantRequests int
+		wantErr      string
+	}{
+		{
+			name:         "fresh cache",
+			elapsed:      30 * time.Minute,
+			wantRequests: 0,
+		},
+		{
+			name:         "expired cache",
+			elapsed:      2 * time.Hour,
+			wantRequests: 2,
+		},
+		{
+			name:         "max-age",
+			cacheControl: "public, max-age=60",
+			elapsed:      2 * time.Minute,
+			wantRequests: 2,
+		},
+		{
+			name:         "no-cache",
+			cacheControl: "no-cache",
+			wantRequests: 2,
+		},
+		{
+			name:         "no-store",
+			cacheControl: "no-store",
+			wantRequests: 2,
+		},
+		{
+			name:         "stale cache while issuer unavailable",
+			elapsed:      2 * time.Hour,
+			unavailable:  true,
+			wantRequests: 2,
+		},
+		{
+			name:         "too stale cache while issuer unavailable",
+			elapsed:      48 * time.Hour,
+			unavailable:  true,
+			wantRequests: 1 + defaultHTTPRetries,
+			wantErr:      "unexpected status 503",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			issuer := newTestIssuer(t)
+			issuer.cacheControl = tc.cacheControl
+
+			cache, err := newFileCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authenticate := func(clock time.Time) error {
+				p := newProvider(issuer.srv.Client(), issuer.srv.URL, cache)
+				p.clock = func() time.Time { return clock }
+
+				auth, err := discoverAuthenticator(ctx, p, "valid-aud")
+				if err != nil {
+					return err
+				}
+
+				_, err = auth.Authenticate(ctx, "jdoe", mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(time.Now().Add(10 * time.Minute).Unix()),
+				}))
+				return err
+			}
+
+			if err := authenticate(now); err != nil {
+				t.Fatal(err)
+			}
+
+			issuer.requests = make(map[string]int)
+			issuer.unavailable = tc.unavailable
+
+			err = authenticate(now.Add(tc.elapsed))
+			if err != nil && tc.wantErr == "" {
+				t.Errorf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Errorf("want err %v, got none", tc.wantErr)
+			}
+
+			requests := 0
+			for _, n := range issuer.requests {
+				requests += n
+			}
+			if requests != tc.wantRequests {
+				t.Errorf("want %d requests, got %v", tc.wantRequests, issuer.requests)
+			}
+		})
+	}
+}
+
+func TestProviderCacheUnknownKey(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+
+	cache, err := newFileCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed the cache with fresh keys that do not include the signing key, as
+	// if the keys were rotated
+	p := issuer.provider()
+	md, err := p.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put(md.JWKSURI, &cacheEntry{
+		Data:    []byte(`{"keys":[]}`),
+		Expires: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p = newProvider(issuer.srv.Client(), issuer.srv.URL, cache)
+	if _, err := p.GetKey(ctx, "test-key"); err != nil {
+		t.Fatalf("want no err, got %v", err)
+	}
+	if issuer.requests["/keys"] != 1 {
+		t.Errorf("want keys to be fetched once, got %d", issuer.requests["/keys"])
+	}
+
+	// The refreshed keys are cached
+	entry, err := cache.Get(md.JWKSURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(entry.Data), "test-key") {
+		t.Errorf("want refreshed keys to be cached, got %s", entry.Data)
+	}
+
+	if _, err := p.GetKey(ctx, "unknown-key"); err == nil || !strings.Contains(err.Error(), "key unknown-key not found") {
+		t.Errorf("want key not found err, got %v", err)
+	}
+}
+
+func TestProviderCacheUnreadable(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		// corrupt damages the cache entry at path.
+		corrupt func(path string) error
+	}{
+		{
+			name: "truncated",
+			corrupt: func(path string) error {
+				return os.WriteFile(path, []byte(`{"data":{"iss`), 0600)
+			},
+		},
+		{
+			name: "invalid data",
+			corrupt: func(path string) error {
+				return os.WriteFile(path, []byte(`{"data":[],"expires":"2999-01-01T00:00:00Z"}`), 0600)
+			},
+		},
+		{
+			name: "writable by others",
+			corrupt: func(path string) error {
+				return os.Chmod(path, 0666)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newTestIssuer(t)
+
+			cache, err := newFileCache(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			url := issuer.srv.URL + wellKnownConfiguration
+			if err := cache.Put(url, &cacheEntry{Data: []byte(`{}`), Expires: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.corrupt(cache.path(url)); err != nil {
+				t.Fatal(err)
+			}
+
+			// The entry is treated as missing, so the metadata is fetched
+			p := newProvider(issuer.srv.Client(), issuer.srv.URL, cache)
+			if _, err := p.Metadata(ctx); err != nil {
+				t.Fatalf("want no err, got %v", err)
+			}
+			if issuer.requests[wellKnownConfiguration] != 1 {
+				t.Errorf("want metadata to be fetched once, got %d", issuer.requests[wellKnownConfiguration])
+			}
+
+			// and the entry is replaced
+			entry, err := cache.Get(url)
+			if err != nil {
+				t.Fatalf("want entry to be replaced, got %v", err)
+			}
+			if !strings.Contains(string(entry.Data), issuer.srv.URL) {
+				t.Errorf("want fetched metadata to be cached, got %s", entry.Data)
+			}
+		})
+	}
+}
+
+func TestFileCachePermissions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFileCache(dir); err == nil || !strings.Contains(err.Error(), "must not be writable by group or others") {
+		t.Errorf("want permission err for directory, got %v", err)
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const url = "https://example.com/keys"
+	if err := cache.Put(url, &cacheEntry{Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(cache.path(url), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(url); err == nil || !strings.Contains(err.Error(), "must not be writable by group or others") {
+		t.Errorf("want permission err for entry, got %v", err)
+	}
+
+	if _, err := newFileCache(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("want err for nonexistent directory, got none")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		cacheControl string
+		want         time.Duration
+		wantOK       bool
+	}{
+		{cacheControl: "", want: defaultCacheTTL, wantOK: true},
+		{cacheControl: "max-age=300", want: 5 * time.Minute, wantOK: true},
+		{cacheControl: `public, max-age="60", must-revalidate`, want: 1 * time.Minute, wantOK: true},
+		{cacheControl: "max-age=invalid", want: defaultCacheTTL, wantOK: true},
+		{cacheControl: "no-cache, max-age=300", want: 0, wantOK: true},
+		{cacheControl: "private, no-store", wantOK: false},
+	}
+
+	for _, tc := range cases {
+		header := http.Header{}
+		header.Set("Cache-Control", tc.cacheControl)
+
+		expires, ok := cacheExpiry(header, now)
+		if ok != tc.wantOK {
+			t.Errorf("%q: want ok %v, got %v", tc.cacheControl, tc.wantOK, ok)
+		} else if ok && !expires.Equal(now.Add(tc.want)) {
+			t.Errorf("%q: want expiry in %v, got %v", tc.cacheControl, tc.want, expires.Sub(now))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pardot/oidc"
+)
+
+// claimOperators are the operators of claim rules. Operators that are a prefix
+// of another operator must come after it.
+var claimOperators = []string{"==", "!=", "=~", "~=", ">=", "<=", ">", "<"}
+
+// claimRule is a predicate on a single claim, of the form `<path><op><value>`,
+// such as `hd==example.com`. The path is parsed by parseClaimPath. The
+// operators are:
+//
+//	==  the claim equals one of the `|`-separated values
+//	!=  the claim equals none of the `|`-separated values
+//	=~  the claim matches the regular expression
+//	~=  the list claim contains one of the `|`-separated values. String
+//	    claims never match, as a substring test is easily satisfied by
+//	    values such as `jdoe@example.com.evil.org`; use == or =~ instead
+//	>=, <=, >, <  the numeric claim compares with the number
+//
+// A rule with only a path requires the claim to be boolean true, such as
+// `email_verified`. Every rule requires the claim to be present.
+type claimRule struct {
+	text   string
+	path   string
+	op     string
+	values []string
+	re     *regexp.Regexp
+	num    float64
+}
+
+// parseClaimRule parses a single claim rule.
+func parseClaimRule(text string) (*claimRule, error) {
+	r := &claimRule{text: text}
+
+	pathEnd, op := findClaimOperator(text)
+	r.path = strings.TrimSpace(text[:pathEnd])
+	r.op = op
+	value := strings.TrimSpace(text[pathEnd+len(op):])
+
+	if _, err := parseClaimPath(r.path); err != nil {
+		return nil, fmt.Errorf("invalid claim rule %q: %v", text, err)
+	} else if op == "" && strings.ContainsAny(r.path, "=!<>~") {
+		return nil, fmt.Errorf("invalid claim rule %q: unknown operator", text)
+	}
+
+	switch op {
+	case "":
+	case "==", "!=", "~=":
+		r.values = strings.Split(value, "|")
+	case "=~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid claim rule %q: %v", text, err)
+		}
+		r.re = re
+	default:
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid claim rule %q: %v is not a number", text, value)
+		}
+		r.num = num
+	}
+
+	return r, nil
+}
+
+// findClaimOperator returns the first operator in text and its index, or the
+// length of text if there is none. Operators within quoted keys of the path
+// are ignored.
+func findClaimOperator(text string) (int, string) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote = text[i]
+		default:
+			for _, op := range claimOperators {
+				if strings.HasPrefix(text[i:], op) {
+					return i, op
+				}
+			}
+		}
+	}
+
+	return len(text), ""
+}
+
+// Check returns an error if the claims do not satisfy the rule. claims are the
+// claims as returned by claimsMap.
+func (r *claimRule) Check(claims map[string]interface{}) error {
+	v := lookupClaim(claims, r.path)
+	if v == nil {
+		return authErrorf(reasonClaimDenied, "claim %s is missing, but %s is required", r.path, r.text)
+	}
+
+	if _, ok := v.([]interface{}); r.op == "~=" && !ok {
+		return authErrorf(reasonClaimDenied, "claim %s is %s, which is not a list, but %s is required", r.path, formatClaim(v), r.text)
+	}
+
+	if !r.matches(v) {
+		return authErrorf(reasonClaimDenied, "claim %s is %s, but %s is required", r.path, formatClaim(v), r.text)
+	}
+
+	return nil
+}
+
+func (r *claimRule) matches(v interface{}) bool {
+	switch r.op {
+	case "":
+		b, ok := v.(bool)
+		return ok && b
+	case "==":
+		s, ok := scalarClaim(v)
+		return ok && containsString(r.values, s)
+	case "!=":
+		s, ok := scalarClaim(v)
+		return ok && !containsString(r.values, s)
+	case "=~":
+		s, ok := scalarClaim(v)
+		return ok && r.re.MatchString(s)
+	case "~=":
+		list, _ := v.([]interface{})
+		for _, elem := range list {
+			if s, ok := scalarClaim(elem); ok && containsString(r.values, s) {
+				return true
+			}
+		}
+		return false
+	default:
+		n, ok := numericClaim(v)
+		if !ok {
+			return false
+		}
+
+		switch r.op {
+		case ">=":
+			return n >= r.num
+		case "<=":
+			return n <= r.num
+		case ">":
+			return n > r.num
+		default:
+			return n < r.num
+		}
+	}
+}
+
+// findClaim returns the claim named key, or else the claim at the path key, or
+// nil if there is none. Claim names may themselves contain dots, such as
+// namespaced claims like `https://example.com/groups`, so are preferred to
+// paths.
+func findClaim(claims map[string]interface{}, key string) interface{} {
+	if v, ok := claims[key]; ok {
+		return v
+	}
+
+	return lookupClaim(claims, key)
+}
+
+// claimsMap returns the claims as a map, as they appear in the token.
+func claimsMap(claims *oidc.Claims) (map[string]interface{}, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// scalarClaim returns a string, number or boolean claim as a string.
+func scalarClaim(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// numericClaim returns a number claim, or a string claim containing a number,
+// as a number.
+func numericClaim(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// formatClaim formats a claim for error messages.
+func formatClaim(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(data)
+}
+
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pardot/oidc"
+)
+
+func TestClaimRule(t *testing.T) {
+	// Claims as issued by Google Workspace, with some custom claims
+	claims := &oidc.Claims{
+		Issuer:  "https://accounts.google.com",
+		Subject: "1234",
+		Extra: map[string]interface{}{
+			"hd":             "example.com",
+			"email":          "jdoe@example.com",
+			"email_verified": true,
+			"amr":            []interface{}{"pwd", "mfa"},
+			"level":          3,
+			"department":     map[string]interface{}{"name": "engineering"},
+			"disabled":       false,
+			"clearance":      "2",
+		},
+	}
+
+	cases := []struct {
+		rule    string
+		wantErr string
+	}{
+		{rule: "hd==example.com"},
+		{rule: "hd == example.com"},
+		{rule: "hd==example.org|example.com"},
+		{rule: "hd==example.org", wantErr: `claim hd is "example.com", but hd==example.org is required`},
+		{rule: "hd!=gmail.com"},
+		{rule: "hd!=gmail.com|example.com", wantErr: `claim hd is "example.com", but hd!=gmail.com|example.com is required`},
+		{rule: "iss==https://accounts.google.com"},
+		{rule: "email=~.*@example\\.com"},
+		{rule: "email=~.*@example", wantErr: `claim email is "jdoe@example.com"`},
+		{rule: "amr~=mfa"},
+		{rule: "amr~=hwk|mfa"},
+		{rule: "amr~=hwk", wantErr: `claim amr is ["pwd","mfa"], but amr~=hwk is required`},
+		{rule: "email~=@example.com", wantErr: `claim email is "jdoe@example.com", which is not a list, but email~=@example.com is required`},
+		{rule: "email~=jdoe@example.com", wantErr: "which is not a list"},
+		{rule: "email_verified"},
+		{rule: "email_verified==true"},
+		{rule: "disabled", wantErr: "claim disabled is false, but disabled is required"},
+		{rule: "disabled==false"},
+		{rule: "level>=3"},
+		{rule: "level>2"},
+		{rule: "level<3", wantErr: "claim level is 3, but level<3 is required"},
+		{rule: "level<=2.5", wantErr: "claim level is 3"},
+		{rule: "clearance>1"},
+		{rule: "hd>1", wantErr: `claim hd is "example.com", but hd>1 is required`},
+		{rule: "department.name==engineering"},
+		{rule: `department["name"]==engineering`},
+		{rule: "department==engineering", wantErr: `claim department is {"name":"engineering"}`},
+		{rule: "groups~=admins", wantErr: "claim groups is missing, but groups~=admins is required"},
+		{rule: "group!=contractors", wantErr: "claim group is missing"},
+	}
+
+	m, err := claimsMap(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		r, err := parseClaimRule(tc.rule)
+		if err != nil {
+			t.Fatalf("parseClaimRule(%q): %v", tc.rule, err)
+		}
+
+		err = r.Check(m)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%q: want no err, got %v", tc.rule, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: want err %v, got %v", tc.rule, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%q: want err %v, got none", tc.rule, tc.wantErr)
+		} else if err != nil && !errors.Is(err, ErrClaimDenied) {
+			t.Errorf("%q: want errors.Is(err, ErrClaimDenied), got %v", tc.rule, err)
+		}
+	}
+}
+
+func TestParseClaimRule(t *testing.T) {
+	cases := []struct {
+		rule    string
+		wantErr string
+	}{
+		{rule: "email_verified"},
+		{rule: `resource_access["a==b"].roles~=admin`},
+		{rule: "hd=example.com", wantErr: "unknown operator"},
+		{rule: "==example.com", wantErr: "empty key"},
+		{rule: "email=~(", wantErr: "missing closing )"},
+		{rule: "level>=high", wantErr: "high is not a number"},
+	}
+
+	for _, tc := range cases {
+		_, err := parseClaimRule(tc.rule)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%q: want no err, got %v", tc.rule, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: want err %v, got %v", tc.rule, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%q: want err %v, got none", tc.rule, tc.wantErr)
+		}
+	}
+}
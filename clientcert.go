@@ -0,0 +1,103 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// clientCertificate is the TLS client certificate presented to the issuer. It
+// is reloaded when the certificate or key file changes on disk, so a rotated
+// certificate is used for new connections without restarting the process.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newClientCertificate loads the certificate and key from certFile and
+// keyFile. The key file must not be accessible by group or others.
+func newClientCertificate(certFile string, keyFile string) (*clientCertificate, error) {
+	c := &clientCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := c.get(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetClientCertificate returns the certificate, for tls.Config.
+func (c *clientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.get()
+}
+
+func (c *clientCertificate) get() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certFi, err := os.Stat(c.certFile)
+	if err != nil {
+		return c.keep(fmt.Errorf("reading client certificate: %v", err))
+	}
+	keyFi, err := os.Stat(c.keyFile)
+	if err != nil {
+		return c.keep(fmt.Errorf("reading client key: %v", err))
+	}
+
+	if c.cert != nil && certFi.ModTime().Equal(c.certMod) && keyFi.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+
+	if err := checkKeyFile(c.keyFile, keyFi); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return c.keep(fmt.Errorf("loading client certificate: %v", err))
+	}
+	c.cert = &cert
+	c.certMod = certFi.ModTime()
+	c.keyMod = keyFi.ModTime()
+
+	return c.cert, nil
+}
+
+// keep returns the certificate already loaded, if any, instead of err. The
+// certificate and key are rarely replaced at the same instant, so one may not
+// match the other, or be missing, while they are rotated.
+func (c *clientCertificate) keep(err error) (*tls.Certificate, error) {
+	if c.cert != nil {
+		return c.cert, nil
+	}
+
+	return nil, err
+}
+
+// checkKeyFile validates that the private key at path is owned by the current
+// user or root, and is not accessible by group or others.
+func checkKeyFile(path string, fi os.FileInfo) error {
+	if err := checkOwnership(path, fi); err != nil {
+		return err
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s must not be accessible by group or others", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCert issues a client certificate for cn, writing the certificate to
+// certFile and, if set, its key to keyFile.
+func (ca *testCA) writeCert(t *testing.T, cn string, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyFile != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// touch sets the modification time of paths to a time after any before, as
+// file systems may not distinguish writes in quick succession.
+func touch(t *testing.T, mod time.Time, paths ...string) {
+	for _, path := range paths {
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	get := func(hc *http.Client) (string, error) {
+		// Each request handshakes again, presenting the current certificate
+		hc.CloseIdleConnections()
+
+		resp, err := hc.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	hc, err := newHTTPClient(httpOptions{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(hc); err == nil {
+		t.Fatal("want err without client certificate, got none")
+	}
+
+	ca.writeCert(t, "host-a", certFile, keyFile)
+	touch(t, time.Now().Add(-time.Minute), certFile, keyFile)
+
+	hc, err = newHTTPClient(httpOptions{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		rotate func()
+		wantCN string
+	}{
+		{
+			name:   "initial certificate",
+			rotate: func() {},
+			wantCN: "host-a",
+		},
+		{
+			name: "rotated certificate",
+			rotate: func() {
+				ca.writeCert(t, "host-b", certFile, keyFile)
+				touch(t, time.Now(), certFile, keyFile)
+			},
+			wantCN: "host-b",
+		},
+		{
+			name: "certificate rotated before key",
+			rotate: func() {
+				ca.writeCert(t, "host-c", certFile, "")
+				touch(t, time.Now().Add(time.Minute), certFile)
+			},
+			wantCN: "host-b",
+		},
+		{
+			name: "key rotated",
+			rotate: func() {
+				ca.writeCert(t, "host-d", certFile, keyFile)
+				touch(t, time.Now().Add(2*time.Minute), certFile, keyFile)
+			},
+			wantCN: "host-d",
+		},
+	}
+
+	for _, step := range steps {
+		step.rotate()
+
+		cn, err := get(hc)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		} else if cn != step.wantCN {
+			t.Errorf("%s: want certificate %s, got %s", step.name, step.wantCN, cn)
+		}
+	}
+}
+
+func TestNewClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+
+	cases := []struct {
+		name    string
+		setup   func(certFile string, keyFile string)
+		wantErr string
+	}{
+		{
+			name: "valid",
+			setup: func(certFile string, keyFile string) {
+				ca.writeCert(t, "host-a", certFile, keyFile)
+			},
+		},
+		{
+			name: "key readable by others",
+			setup: func(certFile string, keyFile string) {
+				ca.writeCert(t, "host-a", certFile, keyFile)
+				if err := os.Chmod(keyFile, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "client.key must not be accessible by group or others",
+		},
+		{
+			name: "missing certificate",
+			setup: func(certFile string, keyFile string) {
+				ca.writeCert(t, "host-a", filepath.Join(filepath.Dir(certFile), "other.pem"), keyFile)
+			},
+			wantErr: "reading client certificate",
+		},
+		{
+			name: "mismatched key",
+			setup: func(certFile string, keyFile string) {
+				ca.writeCert(t, "host-a", certFile, "")
+				ca.writeCert(t, "host-b", filepath.Join(filepath.Dir(certFile), "other.pem"), keyFile)
+			},
+			wantErr: "loading client certificate: tls: private key does not match public key",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile := filepath.Join(dir, "client.pem")
+			keyFile := filepath.Join(dir, "client.key")
+			tc.setup(certFile, keyFile)
+
+			_, err := newClientCertificate(certFile, keyFile)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+		})
+	}
+}
@@ -6,8 +6,43 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// flowToken prompts the user for a token as the PAM password.
+	flowToken = "token"
+	// flowDevice obtains a token using the OAuth 2.0 Device Authorization
+	// Grant, showing the user code through the PAM conversation.
+	flowDevice = "device"
+)
+
+const (
+	// userMatchExact requires the user to equal a candidate exactly.
+	userMatchExact = "exact"
+	// userMatchCaseInsensitive requires the user to equal a candidate, ignoring
+	// case.
+	userMatchCaseInsensitive = "case_insensitive"
+)
+
+const (
+	// userMapFirst consults the user map before the user templates.
+	userMapFirst = "first"
+	// userMapOnly consults the user map instead of the user templates.
+	userMapOnly = "only"
+)
+
+const (
+	// tokenTypeJWT verifies tokens as signed JWTs.
+	tokenTypeJWT = "jwt"
+	// tokenTypeIntrospect validates tokens, which may be opaque, with OAuth 2.0
+	// Token Introspection.
+	tokenTypeIntrospect = "introspect"
 )
 
 type config struct {
@@ -15,53 +50,724 @@ type config struct {
 	Issuer string
 	// Aud is the expected aud(ience) value for valid OIDC tokens
 	Aud string
-	// UserTemplate is a template that, when rendered with the JWT claims, should
-	// match the user being authenticated.
-	UserTemplate string
-	// GroupsClaimKey is the name of the key within the token claims that
-	// specifies which groups a user is a member of.
-	GroupsClaimKey string
+	// UserTemplates are templates that, when rendered with the JWT claims,
+	// should produce candidates, one of which must match the user being
+	// authenticated.
+	UserTemplates []string
+	// UserMapFile is the path to a file listing the users that tokens may
+	// authenticate as.
+	UserMapFile string
+	// UserMapMode is how UserMapFile is used, one of userMapFirst or
+	// userMapOnly. userMapFirst is used by default if not set.
+	UserMapMode string
+	// UserMatch is how the user is compared with the candidates, one of
+	// userMatchExact or userMatchCaseInsensitive. userMatchExact is used by
+	// default if not set.
+	UserMatch string
+	// GroupsClaimKeys are the paths of the claims that specify which groups a
+	// user is a member of.
+	GroupsClaimKeys []string
 	// AuthorizedGroups is a list of groups required for authentication to pass.
 	// A user must be a member of at least one of the groups in the list, if
 	// specified.
 	AuthorizedGroups []string
+	// RequiredGroups is a list of groups a user must be a member of all of.
+	RequiredGroups []string
+	// DeniedGroups is a list of groups whose members are rejected.
+	DeniedGroups []string
+	// AllowedNetworks is a list of networks the remote host must be in.
+	AllowedNetworks []string
+	// DeniedNetworks is a list of networks the remote host must not be in.
+	DeniedNetworks []string
+	// GroupNetworks is a list of networks that members of groups must
+	// authenticate from, of the form `<group>@<network>`.
+	GroupNetworks []string
+	// GroupHours is a list of time windows that members of groups must
+	// authenticate within, of the form `<group>@<days>/<start>-<end>[/<zone>]`.
+	GroupHours []string
+	// AccessStartsClaim is the path of the claim with the time access starts.
+	AccessStartsClaim string
+	// AccessExpiresClaim is the path of the claim with the time access
+	// expires.
+	AccessExpiresClaim string
 	// RequireACRs is a list of required ACRs required for authentication to pass.
 	// one of the acr values must be present in the claims.
 	RequireACRs []string
+	// RequireAMRs is a list of amr values, one of which must be present.
+	RequireAMRs []string
+	// RequireAllAMRs is a list of amr values, all of which must be present.
+	RequireAllAMRs []string
+	// RequireClaims is a list of rules that the claims must all satisfy.
+	RequireClaims []string
+	// Policy is a CEL expression that must allow access.
+	Policy string
+	// DisabledClaimKey is the name of a boolean claim that, when true, marks the
+	// account as disabled during account management.
+	DisabledClaimKey string
+	// MaxTokenAge is the maximum time since the token was issued.
+	MaxTokenAge time.Duration
+	// MaxAuthAge is the maximum time since the user last authenticated with
+	// the issuer.
+	MaxAuthAge time.Duration
+	// ClockSkew is the allowed difference between the clocks of the issuer and
+	// this host when checking MaxTokenAge and MaxAuthAge. defaultClockSkew is
+	// used if nil.
+	ClockSkew *time.Duration
+	// Flow is how the token is obtained, one of flowToken or flowDevice.
+	// flowToken is used by default if not set.
+	Flow string
+	// TokenType is how tokens are validated, one of tokenTypeJWT or
+	// tokenTypeIntrospect. tokenTypeJWT is used by default if not set.
+	TokenType string
+	// ClientID is the OAuth 2.0 client ID used by the device flow and token
+	// introspection.
+	ClientID string
+	// ClientSecret is the OAuth 2.0 client secret used by the device flow and
+	// token introspection.
+	ClientSecret string
+	// Scopes are the scopes requested by the device flow.
+	Scopes []string
+	// CacheDir is a directory in which issuer metadata and signing keys are
+	// cached across processes.
+	CacheDir string
+	// ReplayCache is a file in which used tokens are recorded, so each token
+	// can only be used once.
+	ReplayCache string
+	// Env are the environment variables exported to the PAM environment by
+	// setcred and open_session.
+	Env []envVar
+	// AuditLog is where audit records are written, either auditSyslog or the
+	// path to a file.
+	AuditLog string
 	// HTTPProxy is the HTTP proxy server used to connect to HTTP services.
 	HTTPProxy string
+	// ConnectTimeout is the maximum time to connect to the issuer.
+	ConnectTimeout time.Duration
+	// TLSTimeout is the maximum time for the TLS handshake with the issuer.
+	TLSTimeout time.Duration
+	// HTTPTimeout is the maximum time for each request to the issuer.
+	HTTPTimeout time.Duration
+	// HTTPRetries is the number of times a failed request for metadata or keys
+	// is retried. defaultHTTPRetries is used if nil.
+	HTTPRetries *int
+	// AuthTimeout is the maximum time to verify a token.
+	AuthTimeout time.Duration
+	// CAFile is a file of PEM certificates trusted to connect to the issuer,
+	// instead of the system roots.
+	CAFile string
+	// TLSMinVersion is the minimum TLS version used to connect to the issuer.
+	TLSMinVersion uint16
+	// TLSPins are the base64-encoded SHA-256 hashes of public keys, one of
+	// which must be in the issuer's certificate chain.
+	TLSPins []string
+	// ClientCertFile is the PEM certificate presented to the issuer for mutual
+	// TLS.
+	ClientCertFile string
+	// ClientKeyFile is the PEM private key of ClientCertFile.
+	ClientKeyFile string
+	// Policies are the configs for services and users with their own
+	// authorization policy, in the order they are matched.
+	Policies []*servicePolicy
+	// Base is the config a policy was applied to, whose authorization must
+	// also pass. It is nil unless the config is that of a policy.
+	Base *config
+	// Issuers are the configs for each trusted issuer, if several are trusted.
+	// Each inherits the other options of this config.
+	Issuers []*config
 }
 
-func configFromArgs(args []string) (*config, error) {
+// option is a single configuration option, from either a PAM argument or a
+// configuration file.
+type option struct {
+	key   string
+	value string
+	// source describes where the option was set, for error messages.
+	source string
+}
+
+// configFromArgs parses config from PAM arguments. If the config argument
+// specifies a configuration file, options are loaded from the file first, then
+// from the profile for service, if any, and are finally overridden by the
+// remaining arguments.
+func configFromArgs(args []string, service string) (*config, error) {
 	c := &config{}
 
-	for _, arg := range args {
+	var path, profile string
+	var opts []option
+	for i, arg := range args {
 		parts := strings.SplitN(arg, "=", 2)
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("malformed arg: %v", arg)
 		}
 
 		switch parts[0] {
-		case "issuer":
-			c.Issuer = parts[1]
-		case "aud":
-			c.Aud = parts[1]
-		case "user_template":
-			c.UserTemplate = parts[1]
-		case "groups_claim_key":
-			c.GroupsClaimKey = parts[1]
-		case "authorized_groups":
-			c.AuthorizedGroups = strings.Split(parts[1], ",")
-		case "require_acr":
-			c.RequireACRs = []string{parts[1]}
-		case "require_acrs":
-			c.RequireACRs = strings.Split(parts[1], ",")
-		case "http_proxy":
-			c.HTTPProxy = parts[1]
+		case "config":
+			path = parts[1]
+		case "profile":
+			profile = parts[1]
 		default:
-			return nil, fmt.Errorf("unknown option: %v", parts[0])
+			opts = append(opts, option{
+				key:    parts[0],
+				value:  parts[1],
+				source: fmt.Sprintf("arg %d", i+1),
+			})
+		}
+	}
+
+	var issuers [][]option
+	var policies []policyBlock
+	if path != "" {
+		f, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.applyAll(f.options); err != nil {
+			return nil, err
+		}
+		issuers = f.issuers
+		policies = f.policies
+
+		// An explicit profile must exist, but a profile for the service is
+		// optional.
+		section, ok := f.profiles[service]
+		if profile != "" {
+			if section, ok = f.profiles[profile]; !ok {
+				return nil, fmt.Errorf("%s: unknown profile: %v", path, profile)
+			}
+		}
+		if ok {
+			if err := c.applyAll(section.options); err != nil {
+				return nil, err
+			}
+			if len(section.issuers) > 0 {
+				issuers = section.issuers
+			}
+			if len(section.policies) > 0 {
+				policies = section.policies
+			}
+		}
+	} else if profile != "" {
+		return nil, fmt.Errorf("option profile requires option config")
+	}
+
+	if err := c.applyAll(opts); err != nil {
+		return nil, err
+	}
+
+	// Arguments override the options of every issuer, so are applied again to
+	// each after its own options.
+	for _, issuerOpts := range issuers {
+		ic := *c
+		ic.Issuers = nil
+		if err := ic.applyAll(issuerOpts); err != nil {
+			return nil, err
+		}
+		if err := ic.applyAll(opts); err != nil {
+			return nil, err
+		}
+		c.Issuers = append(c.Issuers, &ic)
+	}
+
+	// Policies add to the options of every issuer, so are applied to each
+	for _, block := range policies {
+		pc, err := c.withPolicy(block.options)
+		if err != nil {
+			return nil, err
+		}
+
+		pc.Issuers = nil
+		for _, ic := range c.Issuers {
+			pic, err := ic.withPolicy(block.options)
+			if err != nil {
+				return nil, err
+			}
+			pc.Issuers = append(pc.Issuers, pic)
+		}
+
+		c.Policies = append(c.Policies, &servicePolicy{
+			Name:    block.name,
+			Service: block.service,
+			User:    block.user,
+			Config:  pc,
+		})
+	}
+
+	return c, nil
+}
+
+// servicePolicy is the config for the PAM services and users matching its
+// patterns.
+type servicePolicy struct {
+	// Name identifies the policy in logs.
+	Name string
+	// Service is a glob matching the PAM service.
+	Service string
+	// User is a glob matching the user, or empty to match any user.
+	User string
+	// Config is the config with the options of the policy applied.
+	Config *config
+}
+
+// withPolicy returns a copy of c with the options of a policy block applied.
+// The policy adds to, rather than replaces, the authorization of c: c is
+// checked first as the Base, and the copy only restricts further. Where both
+// set a maximum token or authentication age, the shorter applies.
+func (c *config) withPolicy(opts []option) (*config, error) {
+	base := *c
+	base.Policies = nil
+	base.Issuers = nil
+
+	pc := base
+	pc.AuthorizedGroups = nil
+	pc.RequiredGroups = nil
+	pc.DeniedGroups = nil
+	pc.AllowedNetworks = nil
+	pc.DeniedNetworks = nil
+	pc.GroupNetworks = nil
+	pc.GroupHours = nil
+	pc.AccessStartsClaim = ""
+	pc.AccessExpiresClaim = ""
+	pc.RequireACRs = nil
+	pc.RequireAMRs = nil
+	pc.RequireAllAMRs = nil
+	pc.RequireClaims = nil
+	pc.Policy = ""
+	if err := pc.applyAll(opts); err != nil {
+		return nil, err
+	}
+
+	pc.MaxTokenAge = shorterAge(c.MaxTokenAge, pc.MaxTokenAge)
+	pc.MaxAuthAge = shorterAge(c.MaxAuthAge, pc.MaxAuthAge)
+	pc.Base = &base
+	return &pc, nil
+}
+
+// shorterAge returns the shorter of two maximum ages, where zero is no
+// maximum.
+func shorterAge(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// forRequest returns the config for the PAM service and user: that of the
+// first matching policy, if any. The policy is nil if none matched.
+func (c *config) forRequest(service string, user string) (*config, *servicePolicy) {
+	for _, p := range c.Policies {
+		if ok, _ := path.Match(p.Service, service); !ok {
+			continue
+		}
+		if ok, _ := path.Match(p.User, user); p.User != "" && !ok {
+			continue
 		}
+
+		return p.Config, p
 	}
 
 	return c, nil
 }
+
+// checkPolicyPattern checks that the service or user pattern of a policy is a
+// valid glob.
+func checkPolicyPattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+func (c *config) applyAll(opts []option) error {
+	// Repeatable options replace, rather than add to, those set by an earlier
+	// call, so arguments override a configuration file as for other options.
+	seen := make(map[string]bool)
+	for _, opt := range opts {
+		if repeatableOptions[opt.key] && !seen[opt.key] {
+			c.reset(opt.key)
+			seen[opt.key] = true
+		}
+
+		if err := c.apply(opt.key, opt.value); err != nil {
+			return fmt.Errorf("%s: %v", opt.source, err)
+		}
+	}
+
+	return nil
+}
+
+// repeatableOptions are the options that may be given more than once, each
+// adding a value.
+var repeatableOptions = map[string]bool{
+	"user_template": true,
+	"require_claim": true,
+	"env":           true,
+}
+
+// reset clears the values of the repeatable option key.
+func (c *config) reset(key string) {
+	switch key {
+	case "user_template":
+		c.UserTemplates = nil
+	case "require_claim":
+		c.RequireClaims = nil
+	case "env":
+		c.Env = nil
+	}
+}
+
+// apply sets the option key to value. List options are comma-separated.
+func (c *config) apply(key string, value string) error {
+	switch key {
+	case "issuer":
+		c.Issuer = value
+	case "aud":
+		c.Aud = value
+	case "user_template":
+		c.UserTemplates = append(c.UserTemplates, value)
+	case "user_map_file":
+		c.UserMapFile = value
+	case "user_map_mode":
+		switch value {
+		case userMapFirst, userMapOnly:
+			c.UserMapMode = value
+		default:
+			return fmt.Errorf("unknown user map mode: %v", value)
+		}
+	case "user_match":
+		switch value {
+		case userMatchExact, userMatchCaseInsensitive:
+			c.UserMatch = value
+		default:
+			return fmt.Errorf("unknown user match: %v", value)
+		}
+	case "groups_claim_key":
+		keys := strings.Split(value, ",")
+		for _, key := range keys {
+			if _, err := parseClaimPath(key); err != nil {
+				return err
+			}
+		}
+		c.GroupsClaimKeys = keys
+	case "authorized_groups":
+		groups, err := splitGroupPatterns(value)
+		if err != nil {
+			return err
+		}
+		c.AuthorizedGroups = groups
+	case "required_groups":
+		groups, err := splitGroupPatterns(value)
+		if err != nil {
+			return err
+		}
+		c.RequiredGroups = groups
+	case "denied_groups":
+		groups, err := splitGroupPatterns(value)
+		if err != nil {
+			return err
+		}
+		c.DeniedGroups = groups
+	case "allowed_networks":
+		networks := strings.Split(value, ",")
+		if _, err := parseNetworks(networks); err != nil {
+			return err
+		}
+		c.AllowedNetworks = networks
+	case "denied_networks":
+		networks := strings.Split(value, ",")
+		if _, err := parseNetworks(networks); err != nil {
+			return err
+		}
+		c.DeniedNetworks = networks
+	case "group_networks":
+		networks := strings.Split(value, ",")
+		if _, err := parseGroupNetworks(networks); err != nil {
+			return err
+		}
+		c.GroupNetworks = networks
+	case "group_hours":
+		windows := strings.Split(value, ",")
+		if _, err := parseTimeWindows(windows); err != nil {
+			return err
+		}
+		c.GroupHours = windows
+	case "access_starts_claim":
+		if _, err := parseClaimPath(value); err != nil {
+			return err
+		}
+		c.AccessStartsClaim = value
+	case "access_expires_claim":
+		if _, err := parseClaimPath(value); err != nil {
+			return err
+		}
+		c.AccessExpiresClaim = value
+	case "require_acr":
+		c.RequireACRs = []string{value}
+	case "require_acrs":
+		c.RequireACRs = strings.Split(value, ",")
+	case "require_amr":
+		c.RequireAMRs = strings.Split(value, ",")
+	case "require_all_amr":
+		c.RequireAllAMRs = strings.Split(value, ",")
+	case "require_claim":
+		if _, err := parseClaimRule(value); err != nil {
+			return err
+		}
+		c.RequireClaims = append(c.RequireClaims, value)
+	case "policy":
+		if _, err := compilePolicy(value); err != nil {
+			return err
+		}
+		c.Policy = value
+	case "disabled_claim_key":
+		c.DisabledClaimKey = value
+	case "max_token_age":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.MaxTokenAge = d
+	case "max_auth_age":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.MaxAuthAge = d
+	case "clock_skew":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.ClockSkew = &d
+	case "flow":
+		switch value {
+		case flowToken, flowDevice:
+			c.Flow = value
+		default:
+			return fmt.Errorf("unknown flow: %v", value)
+		}
+	case "token_type":
+		switch value {
+		case tokenTypeJWT, tokenTypeIntrospect:
+			c.TokenType = value
+		default:
+			return fmt.Errorf("unknown token type: %v", value)
+		}
+	case "client_id":
+		c.ClientID = value
+	case "client_secret":
+		c.ClientSecret = value
+	case "scopes":
+		c.Scopes = strings.Split(value, ",")
+	case "cache_dir":
+		c.CacheDir = value
+	case "replay_cache":
+		c.ReplayCache = value
+	case "env":
+		v, err := parseEnvVar(value)
+		if err != nil {
+			return err
+		}
+		c.Env = append(c.Env, v)
+	case "audit_log":
+		c.AuditLog = value
+	case "http_proxy":
+		c.HTTPProxy = value
+	case "connect_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.ConnectTimeout = d
+	case "tls_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.TLSTimeout = d
+	case "http_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.HTTPTimeout = d
+	case "http_retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of retries: %v", value)
+		}
+		c.HTTPRetries = &n
+	case "auth_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.AuthTimeout = d
+	case "ca_file":
+		c.CAFile = value
+	case "tls_min_version":
+		v, ok := tlsVersions[value]
+		if !ok {
+			return fmt.Errorf("unknown TLS version: %v", value)
+		}
+		c.TLSMinVersion = v
+	case "tls_pin_sha256":
+		pins := strings.Split(value, ",")
+		for _, pin := range pins {
+			if err := parseTLSPin(pin); err != nil {
+				return err
+			}
+		}
+		c.TLSPins = pins
+	case "client_cert_file":
+		c.ClientCertFile = value
+	case "client_key_file":
+		c.ClientKeyFile = value
+	default:
+		return fmt.Errorf("unknown option: %v", key)
+	}
+
+	return nil
+}
+
+// parseDuration parses a non-negative duration, such as "5m" or "1h30m".
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %v", value)
+	} else if d < 0 {
+		return 0, fmt.Errorf("negative duration: %v", value)
+	}
+
+	return d, nil
+}
+
+// splitGroupPatterns splits a comma-separated list of group patterns,
+// checking that each is valid.
+func splitGroupPatterns(value string) ([]string, error) {
+	groups := strings.Split(value, ",")
+	if _, err := parseGroupPatterns(groups); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// provider returns a provider for the issuer, using the HTTP and TLS options
+// and cache directory, if any.
+func (c *config) provider() (*provider, error) {
+	var cache *fileCache
+	if c.CacheDir != "" {
+		var err error
+		if cache, err = newFileCache(c.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+
+	hc, err := newHTTPClient(httpOptions{
+		Proxy:          c.HTTPProxy,
+		ConnectTimeout: c.ConnectTimeout,
+		TLSTimeout:     c.TLSTimeout,
+		Timeout:        c.HTTPTimeout,
+		CAFile:         c.CAFile,
+		TLSMinVersion:  c.TLSMinVersion,
+		TLSPins:        c.TLSPins,
+		ClientCertFile: c.ClientCertFile,
+		ClientKeyFile:  c.ClientKeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := newProvider(hc, c.Issuer, cache)
+	if c.HTTPRetries != nil {
+		p.retries = *c.HTTPRetries
+	}
+
+	return p, nil
+}
+
+// setAuthorization sets the options of a that authorize a verified token,
+// which are checked both when authenticating and in account management, with
+// request as the PAM context of the policy.
+func (c *config) setAuthorization(a *authenticator, request policyRequest) {
+	a.GroupsClaimKeys = c.GroupsClaimKeys
+	a.AuthorizedGroups = c.AuthorizedGroups
+	a.RequiredGroups = c.RequiredGroups
+	a.DeniedGroups = c.DeniedGroups
+	a.AllowedNetworks = c.AllowedNetworks
+	a.DeniedNetworks = c.DeniedNetworks
+	a.GroupNetworks = c.GroupNetworks
+	a.GroupHours = c.GroupHours
+	a.AccessStartsClaim = c.AccessStartsClaim
+	a.AccessExpiresClaim = c.AccessExpiresClaim
+	a.RequireACRs = c.RequireACRs
+	a.RequireAMRs = c.RequireAMRs
+	a.RequireAllAMRs = c.RequireAllAMRs
+	a.RequireClaims = c.RequireClaims
+	a.Policy = c.Policy
+	a.Request = request
+	a.DisabledClaimKey = c.DisabledClaimKey
+
+	a.Base = nil
+	if c.Base != nil {
+		a.Base = &authenticator{}
+		c.Base.setAuthorization(a.Base, request)
+	}
+}
+
+// forIssuer returns the config for the issuer. If a single issuer is trusted,
+// its config is returned regardless of issuer.
+func (c *config) forIssuer(issuer string) (*config, error) {
+	if len(c.Issuers) == 0 {
+		return c, nil
+	}
+
+	for _, ic := range c.Issuers {
+		if ic.Issuer == issuer {
+			return ic, nil
+		}
+	}
+
+	return nil, authErrorf(reasonUntrustedIssuer, "issuer %q is not trusted", issuer)
+}
+
+// validate validates that the options required for authentication are set
+// and consistent with each other.
+func (c *config) validate() error {
+	if len(c.Issuers) > 0 {
+		if c.Flow == flowDevice {
+			return errors.New("device flow requires a single issuer")
+		}
+
+		seen := make(map[string]bool)
+		for i, ic := range c.Issuers {
+			if err := ic.validate(); err != nil {
+				return fmt.Errorf("issuers[%d]: %v", i, err)
+			} else if ic.TokenType == tokenTypeIntrospect {
+				return fmt.Errorf("issuers[%d]: token introspection requires a single issuer", i)
+			} else if seen[ic.Issuer] {
+				return fmt.Errorf("issuers[%d]: duplicate issuer: %v", i, ic.Issuer)
+			}
+			seen[ic.Issuer] = true
+		}
+
+		return nil
+	}
+
+	if c.Issuer == "" {
+		return errors.New("missing required option: issuer")
+	} else if c.Aud == "" {
+		return errors.New("missing required option: aud")
+	} else if c.Flow == flowDevice && c.ClientID == "" {
+		return errors.New("missing required option for device flow: client_id")
+	} else if c.TokenType == tokenTypeIntrospect && c.ClientID == "" {
+		return errors.New("missing required option for token introspection: client_id")
+	} else if c.UserMapMode == userMapOnly && c.UserMapFile == "" {
+		return errors.New("missing required option for user map mode only: user_map_file")
+	} else if c.ClientCertFile != "" && c.ClientKeyFile == "" {
+		return errors.New("missing required option for client certificate: client_key_file")
+	} else if c.ClientKeyFile != "" && c.ClientCertFile == "" {
+		return errors.New("missing required option for client key: client_cert_file")
+	}
+
+	return nil
+}
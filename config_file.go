@@ -0,0 +1,403 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is a parsed configuration file.
+//
+// A configuration file is a YAML mapping of the same options accepted as PAM
+// arguments. List options may be given as YAML sequences. Named profiles,
+// under the `profiles` key, override options when selected:
+//
+//	issuer: https://accounts.google.com
+//	aud: 12345-v12345.apps.googleusercontent.com
+//	user_template: '{{.Extra.email | trimSuffix "@example.com"}}'
+//	profiles:
+//	  sshd:
+//	    authorized_groups: [ssh-users]
+//	  sudo:
+//	    authorized_groups:
+//	      - admins
+//	    require_acr: mfa
+//
+// Options that may be given more than once, such as `env`, are given as YAML
+// sequences, with one value per element.
+//
+// Several issuers may be trusted with the `issuers` key, at the top level or
+// in a profile. Each issuer inherits the other options, and may override them:
+//
+//	issuers:
+//	  - issuer: https://example.okta.com
+//	    aud: 0oa1abcd
+//	    authorized_groups: [engineering]
+//	  - issuer: https://accounts.google.com
+//	    aud: 12345-v12345.apps.googleusercontent.com
+//	    user_template: '{{.Extra.email}}'
+//
+// Authorization options may be given for particular PAM services, and
+// optionally target users, with the `policies` key. The first policy whose
+// `service` and `user` globs match is checked in addition to the other
+// options:
+//
+//	policies:
+//	  - service: sudo
+//	    required_groups: [admins]
+//	    require_amr: mfa
+//	  - service: mysqld
+//	    user: 'app-*'
+//	    authorized_groups: [dba, app-owners]
+//	  - service: mysqld
+//	    authorized_groups: [dba]
+type configFile struct {
+	configSection
+	profiles map[string]*configSection
+}
+
+// configSection is the top level of a configuration file, or a profile.
+type configSection struct {
+	options []option
+	// issuers are the options for each trusted issuer, if specified.
+	issuers [][]option
+	// policies are the authorization policies for services and users, if
+	// specified.
+	policies []policyBlock
+}
+
+// policyBlock is an entry of the `policies` list, with the authorization
+// options for the services and users matching its patterns.
+type policyBlock struct {
+	// name identifies the block in logs, e.g. `policies[1]`.
+	name    string
+	service string
+	user    string
+	options []option
+}
+
+// policyOptions are the options that may be given in a policy block.
+var policyOptions = map[string]bool{
+	"groups_claim_key":     true,
+	"authorized_groups":    true,
+	"required_groups":      true,
+	"denied_groups":        true,
+	"allowed_networks":     true,
+	"denied_networks":      true,
+	"group_networks":       true,
+	"group_hours":          true,
+	"access_starts_claim":  true,
+	"access_expires_claim": true,
+	"require_acr":          true,
+	"require_acrs":         true,
+	"require_amr":          true,
+	"require_all_amr":      true,
+	"require_claim":        true,
+	"policy":               true,
+	"disabled_claim_key":   true,
+	"max_token_age":        true,
+	"max_auth_age":         true,
+}
+
+// readConfigFile reads and parses the configuration file at path. Because it
+// decides which issuers are trusted, the file must be owned by the current
+// user or root, and must not be writable by others. If it contains a client
+// secret, it must not be readable by others either.
+func readConfigFile(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	} else if err := checkOwnership(path, fi); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+
+	cf, err := parseConfigFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if cf.hasOption("client_secret") && fi.Mode().Perm()&0004 != 0 {
+		return nil, fmt.Errorf("%s contains client_secret, so must not be readable by others", path)
+	}
+
+	return cf, nil
+}
+
+// hasOption reports whether the option key is set anywhere in the file,
+// including in profiles and issuers.
+func (f *configFile) hasOption(key string) bool {
+	sections := []*configSection{&f.configSection}
+	for _, section := range f.profiles {
+		sections = append(sections, section)
+	}
+
+	for _, section := range sections {
+		all := [][]option{section.options}
+		all = append(all, section.issuers...)
+		for _, block := range section.policies {
+			all = append(all, block.options)
+		}
+
+		for _, opts := range all {
+			for _, opt := range opts {
+				if opt.key == key {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func parseConfigFile(path string, data []byte) (*configFile, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	f := &configFile{
+		profiles: make(map[string]*configSection),
+	}
+
+	// An empty document has no content
+	if len(doc.Content) == 0 {
+		return f, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d:%d: expected a mapping of options", path, root.Line, root.Column)
+	}
+
+	err := walkMapping(path, "", root, func(key string, field string, node *yaml.Node) error {
+		if key != "profiles" {
+			return f.configSection.parse(path, key, field, node)
+		}
+
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s:%d:%d: %s: expected a mapping of profiles", path, node.Line, node.Column, field)
+		}
+
+		return walkMapping(path, field, node, func(name string, field string, node *yaml.Node) error {
+			if node.Kind != yaml.MappingNode {
+				return fmt.Errorf("%s:%d:%d: %s: expected a mapping of options", path, node.Line, node.Column, field)
+			}
+
+			section := &configSection{}
+			if err := walkMapping(path, field, node, func(key string, field string, node *yaml.Node) error {
+				return section.parse(path, key, field, node)
+			}); err != nil {
+				return err
+			}
+
+			f.profiles[name] = section
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate option names and values up front, so errors in profiles that
+	// are not selected are reported too.
+	if err := f.configSection.validate(); err != nil {
+		return nil, err
+	}
+	for _, section := range f.profiles {
+		if err := section.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// parse parses a single entry of the section.
+func (s *configSection) parse(path string, key string, field string, node *yaml.Node) error {
+	if key == "policies" {
+		return s.parsePolicies(path, field, node)
+	} else if key != "issuers" {
+		opts, err := nodeOptions(path, key, field, node)
+		if err != nil {
+			return err
+		}
+		s.options = append(s.options, opts...)
+		return nil
+	}
+
+	if node.Kind != yaml.SequenceNode || len(node.Content) == 0 {
+		return fmt.Errorf("%s:%d:%d: %s: expected a list of issuers", path, node.Line, node.Column, field)
+	}
+
+	for i, item := range node.Content {
+		field := fmt.Sprintf("%s[%d]", field, i)
+		if item.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s:%d:%d: %s: expected a mapping of options", path, item.Line, item.Column, field)
+		}
+
+		opts := []option{}
+		if err := walkMapping(path, field, item, func(key string, field string, node *yaml.Node) error {
+			nodeOpts, err := nodeOptions(path, key, field, node)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, nodeOpts...)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		s.issuers = append(s.issuers, opts)
+	}
+
+	return nil
+}
+
+// parsePolicies parses the `policies` list of the section.
+func (s *configSection) parsePolicies(path string, field string, node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode || len(node.Content) == 0 {
+		return fmt.Errorf("%s:%d:%d: %s: expected a list of policies", path, node.Line, node.Column, field)
+	}
+
+	for i, item := range node.Content {
+		field := fmt.Sprintf("%s[%d]", field, i)
+		if item.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s:%d:%d: %s: expected a mapping of options", path, item.Line, item.Column, field)
+		}
+
+		block := policyBlock{name: field, options: []option{}}
+		if err := walkMapping(path, field, item, func(key string, field string, node *yaml.Node) error {
+			switch {
+			case key == "service" || key == "user":
+				if node.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s:%d:%d: %s: expected a pattern", path, node.Line, node.Column, field)
+				} else if err := checkPolicyPattern(node.Value); err != nil {
+					return fmt.Errorf("%s:%d:%d: %s: invalid pattern: %v", path, node.Line, node.Column, field, err)
+				}
+
+				if key == "service" {
+					block.service = node.Value
+				} else {
+					block.user = node.Value
+				}
+				return nil
+			case !policyOptions[key]:
+				return fmt.Errorf("%s:%d:%d: %s: option cannot be set in a policy", path, node.Line, node.Column, field)
+			}
+
+			nodeOpts, err := nodeOptions(path, key, field, node)
+			if err != nil {
+				return err
+			}
+			block.options = append(block.options, nodeOpts...)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if block.service == "" {
+			return fmt.Errorf("%s:%d:%d: %s: missing required key: service", path, item.Line, item.Column, field)
+		}
+
+		s.policies = append(s.policies, block)
+	}
+
+	return nil
+}
+
+// validate validates the option names and values of the section.
+func (s *configSection) validate() error {
+	if err := new(config).applyAll(s.options); err != nil {
+		return err
+	}
+	for _, opts := range s.issuers {
+		if err := new(config).applyAll(opts); err != nil {
+			return err
+		}
+	}
+	for _, block := range s.policies {
+		if err := new(config).applyAll(block.options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkMapping calls fn for each entry in the mapping node, with the dotted
+// field path of the entry. Duplicate keys are an error.
+func walkMapping(path string, prefix string, node *yaml.Node, fn func(key string, field string, value *yaml.Node) error) error {
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+
+		field := keyNode.Value
+		if prefix != "" {
+			field = prefix + "." + keyNode.Value
+		}
+
+		if keyNode.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s:%d:%d: expected a string key", path, keyNode.Line, keyNode.Column)
+		} else if seen[keyNode.Value] {
+			return fmt.Errorf("%s:%d:%d: %s: duplicate key", path, keyNode.Line, keyNode.Column, field)
+		}
+		seen[keyNode.Value] = true
+
+		if err := fn(keyNode.Value, field, valueNode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeOptions converts a scalar or sequence of scalars to options. Sequences
+// are joined with commas, like list options given as PAM arguments, except
+// for repeatable options, which are given once for each element.
+func nodeOptions(path string, key string, field string, node *yaml.Node) ([]option, error) {
+	source := func(node *yaml.Node) string {
+		return fmt.Sprintf("%s:%d:%d: %s", path, node.Line, node.Column, field)
+	}
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []option{{key: key, value: node.Value, source: source(node)}}, nil
+	case yaml.SequenceNode:
+		opts := make([]option, 0, len(node.Content))
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%s:%d:%d: %s: expected a list of strings", path, item.Line, item.Column, field)
+			}
+			opts = append(opts, option{key: key, value: item.Value, source: source(item)})
+			values = append(values, item.Value)
+		}
+
+		if repeatableOptions[key] {
+			return opts, nil
+		}
+		return []option{{key: key, value: strings.Join(values, ","), source: source(node)}}, nil
+	default:
+		return nil, fmt.Errorf("%s:%d:%d: %s: expected a string or list of strings", path, node.Line, node.Column, field)
+	}
+}
@@ -6,10 +6,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/pardot/oidc"
 )
 
 func TestParseConfigFromArgs(t *testing.T) {
@@ -33,8 +40,8 @@ func TestParseConfigFromArgs(t *testing.T) {
 			want: &config{
 				Issuer:           "https://example.com",
 				Aud:              "example-aud",
-				UserTemplate:     `{{.Email}}`,
-				GroupsClaimKey:   "roles",
+				UserTemplates:    []string{`{{.Email}}`},
+				GroupsClaimKeys:  []string{"roles"},
 				AuthorizedGroups: []string{"foo", "bar", "baz"},
 				RequireACRs:      []string{"foo"},
 				HTTPProxy:        "http://example.com:8080",
@@ -46,25 +53,315 @@ func TestParseConfigFromArgs(t *testing.T) {
 			want: &config{
 				Issuer:           "https://example.com",
 				Aud:              "example-aud",
-				UserTemplate:     `{{.Email}}`,
-				GroupsClaimKey:   "roles",
+				UserTemplates:    []string{`{{.Email}}`},
+				GroupsClaimKeys:  []string{"roles"},
 				AuthorizedGroups: []string{"foo", "bar", "baz"},
 				RequireACRs:      []string{"acr1", "acr2", "acr3"},
 				HTTPProxy:        "http://example.com:8080",
 			},
 		},
 
+		{
+			name: "account management options",
+			args: []string{"authorized_groups=foo", "disabled_claim_key=disabled"},
+			want: &config{
+				AuthorizedGroups: []string{"foo"},
+				DisabledClaimKey: "disabled",
+			},
+		},
+		{
+			name: "several groups claims",
+			args: []string{`groups_claim_key=groups,realm_access.roles,resource_access["my.client"].roles`},
+			want: &config{
+				GroupsClaimKeys: []string{"groups", "realm_access.roles", `resource_access["my.client"].roles`},
+			},
+		},
+		{
+			name:    "invalid groups claim",
+			args:    []string{"groups_claim_key=realm_access..roles"},
+			wantErr: `arg 1: invalid claim path "realm_access..roles": empty key`,
+		},
+		{
+			name: "network restrictions",
+			args: []string{"allowed_networks=10.0.0.0/8,192.0.2.1", "denied_networks=10.66.0.0/16", "group_networks=contractors@10.8.0.0/16,eng@example.com@10.9.0.0/16"},
+			want: &config{
+				AllowedNetworks: []string{"10.0.0.0/8", "192.0.2.1"},
+				DeniedNetworks:  []string{"10.66.0.0/16"},
+				GroupNetworks:   []string{"contractors@10.8.0.0/16", "eng@example.com@10.9.0.0/16"},
+			},
+		},
+		{
+			name:    "invalid network",
+			args:    []string{"allowed_networks=10.0.0.0/8,bastion"},
+			wantErr: `arg 1: invalid network "bastion"`,
+		},
+		{
+			name:    "invalid group network",
+			args:    []string{"group_networks=10.8.0.0/16"},
+			wantErr: `arg 1: invalid group network "10.8.0.0/16": expected <group>@<network>`,
+		},
+		{
+			name: "http timeouts and retries",
+			args: []string{"connect_timeout=2s", "tls_timeout=3s", "http_timeout=5s", "http_retries=0", "auth_timeout=20s"},
+			want: &config{
+				ConnectTimeout: 2 * time.Second,
+				TLSTimeout:     3 * time.Second,
+				HTTPTimeout:    5 * time.Second,
+				HTTPRetries:    new(int),
+				AuthTimeout:    20 * time.Second,
+			},
+		},
+		{
+			name: "tls options",
+			args: []string{"ca_file=/etc/pam_oidc/ca.pem", "tls_min_version=1.3", "tls_pin_sha256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=,OJ+e3lINvDPSrrxIkkatieIh0ewV9pPDSMWLCCGTZ6o="},
+			want: &config{
+				CAFile:        "/etc/pam_oidc/ca.pem",
+				TLSMinVersion: tls.VersionTLS13,
+				TLSPins:       []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "OJ+e3lINvDPSrrxIkkatieIh0ewV9pPDSMWLCCGTZ6o="},
+			},
+		},
+		{
+			name: "client certificate",
+			args: []string{"client_cert_file=/etc/pam_oidc/client.pem", "client_key_file=/etc/pam_oidc/client.key"},
+			want: &config{
+				ClientCertFile: "/etc/pam_oidc/client.pem",
+				ClientKeyFile:  "/etc/pam_oidc/client.key",
+			},
+		},
+		{
+			name:    "unknown tls version",
+			args:    []string{"tls_min_version=1.4"},
+			wantErr: "arg 1: unknown TLS version: 1.4",
+		},
+		{
+			name:    "invalid tls pin",
+			args:    []string{"tls_pin_sha256=sha256//abc"},
+			wantErr: `arg 1: invalid pin "sha256//abc": expected base64-encoded SHA-256 hash`,
+		},
+		{
+			name:    "invalid retries",
+			args:    []string{"http_retries=-1"},
+			wantErr: "arg 1: invalid number of retries: -1",
+		},
+		{
+			name: "time restrictions",
+			args: []string{"group_hours=contractors@mon-fri/09:00-17:00/America/New_York,oncall@*/00:00-24:00", "access_starts_claim=jit.starts", "access_expires_claim=access_expires_at"},
+			want: &config{
+				GroupHours:         []string{"contractors@mon-fri/09:00-17:00/America/New_York", "oncall@*/00:00-24:00"},
+				AccessStartsClaim:  "jit.starts",
+				AccessExpiresClaim: "access_expires_at",
+			},
+		},
+		{
+			name:    "invalid time window",
+			args:    []string{"group_hours=contractors@weekdays/09:00-17:00"},
+			wantErr: `arg 1: invalid time window "contractors@weekdays/09:00-17:00": unknown day: weekdays`,
+		},
+		{
+			name: "amr requirements",
+			args: []string{"require_amr=mfa,hwk", "require_all_amr=pwd,otp"},
+			want: &config{
+				RequireAMRs:    []string{"mfa", "hwk"},
+				RequireAllAMRs: []string{"pwd", "otp"},
+			},
+		},
+		{
+			name: "policy",
+			args: []string{"policy='sre'in(claims.groups)"},
+			want: &config{
+				Policy: "'sre'in(claims.groups)",
+			},
+		},
+		{
+			name:    "invalid policy",
+			args:    []string{"policy=claims.groups"},
+			wantErr: "arg 1: invalid policy: must evaluate to bool, not dyn",
+		},
+		{
+			name: "claim rules",
+			args: []string{"require_claim=hd==example.com", "require_claim=email_verified"},
+			want: &config{
+				RequireClaims: []string{"hd==example.com", "email_verified"},
+			},
+		},
+		{
+			name:    "invalid claim rule",
+			args:    []string{"require_claim=level>=high"},
+			wantErr: `arg 1: invalid claim rule "level>=high": high is not a number`,
+		},
+		{
+			name: "group patterns",
+			args: []string{"authorized_groups=glob:team-db-*,re:eng-(web|api)", "required_groups=engineering", "denied_groups=contractors"},
+			want: &config{
+				AuthorizedGroups: []string{"glob:team-db-*", "re:eng-(web|api)"},
+				RequiredGroups:   []string{"engineering"},
+				DeniedGroups:     []string{"contractors"},
+			},
+		},
+		{
+			name:    "invalid glob group pattern",
+			args:    []string{"denied_groups=glob:team-[db"},
+			wantErr: `arg 1: invalid group pattern "glob:team-[db": syntax error in pattern`,
+		},
+		{
+			name:    "invalid regexp group pattern",
+			args:    []string{"required_groups=re:team-(db"},
+			wantErr: `arg 1: invalid group pattern "re:team-(db"`,
+		},
+		{
+			name: "device flow",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "flow=device", "client_id=example-client", "client_secret=example-secret", "scopes=openid,groups"},
+			want: &config{
+				Issuer:       "https://example.com",
+				Aud:          "example-aud",
+				Flow:         flowDevice,
+				ClientID:     "example-client",
+				ClientSecret: "example-secret",
+				Scopes:       []string{"openid", "groups"},
+			},
+		},
+		{
+			name: "cache directory",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "cache_dir=/var/cache/pam_oidc"},
+			want: &config{
+				Issuer:   "https://example.com",
+				Aud:      "example-aud",
+				CacheDir: "/var/cache/pam_oidc",
+			},
+		},
+		{
+			name: "token and authentication age",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "max_token_age=10m", "max_auth_age=1h30m", "clock_skew=30s"},
+			want: &config{
+				Issuer:      "https://example.com",
+				Aud:         "example-aud",
+				MaxTokenAge: 10 * time.Minute,
+				MaxAuthAge:  90 * time.Minute,
+				ClockSkew:   durationPtr(30 * time.Second),
+			},
+		},
+		{
+			name: "no clock skew",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "max_auth_age=5m", "clock_skew=0s"},
+			want: &config{
+				Issuer:     "https://example.com",
+				Aud:        "example-aud",
+				MaxAuthAge: 5 * time.Minute,
+				ClockSkew:  durationPtr(0),
+			},
+		},
+		{
+			name:    "invalid duration",
+			args:    []string{"issuer=https://example.com", "max_auth_age=5"},
+			wantErr: "arg 2: invalid duration: 5",
+		},
+		{
+			name:    "negative duration",
+			args:    []string{"issuer=https://example.com", "clock_skew=-1m"},
+			wantErr: "arg 2: negative duration: -1m",
+		},
+		{
+			name: "several user templates",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "user_template={{.Extra.preferred_username}}", "user_template={{.Extra.email}}", "user_match=case_insensitive"},
+			want: &config{
+				Issuer:        "https://example.com",
+				Aud:           "example-aud",
+				UserTemplates: []string{"{{.Extra.preferred_username}}", "{{.Extra.email}}"},
+				UserMatch:     userMatchCaseInsensitive,
+			},
+		},
+		{
+			name:    "invalid user match",
+			args:    []string{"issuer=https://example.com", "user_match=fuzzy"},
+			wantErr: "arg 2: unknown user match: fuzzy",
+		},
+		{
+			name: "user map file",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "user_map_file=/etc/pam_oidc/users", "user_map_mode=only"},
+			want: &config{
+				Issuer:      "https://example.com",
+				Aud:         "example-aud",
+				UserMapFile: "/etc/pam_oidc/users",
+				UserMapMode: userMapOnly,
+			},
+		},
+		{
+			name: "environment",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "env=OIDC_SUBJECT={{.Subject}}", "env=OIDC_EMAIL={{.Extra.email}}"},
+			want: &config{
+				Issuer: "https://example.com",
+				Aud:    "example-aud",
+				Env: []envVar{
+					{Name: "OIDC_SUBJECT", Template: "{{.Subject}}"},
+					{Name: "OIDC_EMAIL", Template: "{{.Extra.email}}"},
+				},
+			},
+		},
+		{
+			name:    "invalid environment variable name",
+			args:    []string{"issuer=https://example.com", "env=OIDC-SUBJECT={{.Subject}}"},
+			wantErr: "arg 2: invalid environment variable name: OIDC-SUBJECT",
+		},
+		{
+			name: "audit log",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "audit_log=syslog"},
+			want: &config{
+				Issuer:   "https://example.com",
+				Aud:      "example-aud",
+				AuditLog: auditSyslog,
+			},
+		},
+		{
+			name: "replay cache",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "replay_cache=/var/lib/pam_oidc/replay.json"},
+			want: &config{
+				Issuer:      "https://example.com",
+				Aud:         "example-aud",
+				ReplayCache: "/var/lib/pam_oidc/replay.json",
+			},
+		},
+		{
+			name:    "invalid flow",
+			args:    []string{"issuer=https://example.com", "flow=invalid"},
+			wantErr: "unknown flow: invalid",
+		},
+		{
+			name: "token introspection",
+			args: []string{"issuer=https://example.com", "aud=example-aud", "token_type=introspect", "client_id=example-client", "client_secret=example-secret"},
+			want: &config{
+				Issuer:       "https://example.com",
+				Aud:          "example-aud",
+				TokenType:    tokenTypeIntrospect,
+				ClientID:     "example-client",
+				ClientSecret: "example-secret",
+			},
+		},
+		{
+			name:    "invalid token type",
+			args:    []string{"issuer=https://example.com", "token_type=invalid"},
+			wantErr: "unknown token type: invalid",
+		},
 		{
 			name:    "invalid option",
 			args:    []string{"issuer=https://example.com", "invalid=foo"},
-			wantErr: "unknown option: invalid",
+			wantErr: "arg 2: unknown option: invalid",
+		},
+		{
+			name:    "profile without config",
+			args:    []string{"issuer=https://example.com", "profile=sshd"},
+			wantErr: "option profile requires option config",
+		},
+		{
+			name:    "missing config file",
+			args:    []string{"config=/nonexistent/pam_oidc.yaml"},
+			wantErr: "reading config file",
 		},
 	}
 
 	for _, tc := range cases {
 		tc := tc
 
-		config, err := configFromArgs(tc.args)
+		config, err := configFromArgs(tc.args, "")
 		if err != nil && tc.wantErr == "" {
 			t.Fatalf("wanted no error, but got %v", err)
 		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
@@ -78,3 +375,749 @@ func TestParseConfigFromArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestParseConfigFromFile(t *testing.T) {
+	const file = `
+issuer: https://example.com
+aud: example-aud
+user_template: '{{.Extra.email | trimSuffix "@example.com"}}'
+authorized_groups: [foo, bar]
+profiles:
+  sshd:
+    authorized_groups:
+      - ssh-users
+  sudo:
+    authorized_groups: admins
+    require_acrs: [mfa, hwk]
+`
+
+	const fileWithEnv = `
+issuer: https://example.com
+aud: example-aud
+env:
+  - OIDC_SUBJECT={{.Subject}}
+  - OIDC_GROUPS={{.Extra.groups | join ","}}
+`
+
+	cases := []struct {
+		name    string
+		file    string
+		args    []string
+		service string
+		want    *config
+		wantErr string
+	}{
+		{
+			name: "file without profile",
+			file: file,
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "example-aud",
+				UserTemplates:    []string{`{{.Extra.email | trimSuffix "@example.com"}}`},
+				AuthorizedGroups: []string{"foo", "bar"},
+			},
+		},
+		{
+			name:    "profile selected by service",
+			file:    file,
+			service: "sshd",
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "example-aud",
+				UserTemplates:    []string{`{{.Extra.email | trimSuffix "@example.com"}}`},
+				AuthorizedGroups: []string{"ssh-users"},
+			},
+		},
+		{
+			name:    "service without profile",
+			file:    file,
+			service: "login",
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "example-aud",
+				UserTemplates:    []string{`{{.Extra.email | trimSuffix "@example.com"}}`},
+				AuthorizedGroups: []string{"foo", "bar"},
+			},
+		},
+		{
+			name:    "explicit profile overrides service",
+			file:    file,
+			args:    []string{"profile=sudo"},
+			service: "sshd",
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "example-aud",
+				UserTemplates:    []string{`{{.Extra.email | trimSuffix "@example.com"}}`},
+				AuthorizedGroups: []string{"admins"},
+				RequireACRs:      []string{"mfa", "hwk"},
+			},
+		},
+		{
+			name: "repeatable option in file",
+			file: fileWithEnv,
+			want: &config{
+				Issuer: "https://example.com",
+				Aud:    "example-aud",
+				Env: []envVar{
+					{Name: "OIDC_SUBJECT", Template: "{{.Subject}}"},
+					{Name: "OIDC_GROUPS", Template: `{{.Extra.groups | join ","}}`},
+				},
+			},
+		},
+		{
+			name: "repeatable option in args replaces file",
+			file: fileWithEnv,
+			args: []string{"env=OIDC_EMAIL={{.Extra.email}}", "env=OIDC_ISSUER={{.Issuer}}"},
+			want: &config{
+				Issuer: "https://example.com",
+				Aud:    "example-aud",
+				Env: []envVar{
+					{Name: "OIDC_EMAIL", Template: "{{.Extra.email}}"},
+					{Name: "OIDC_ISSUER", Template: "{{.Issuer}}"},
+				},
+			},
+		},
+		{
+			name:    "args override file and profile",
+			file:    file,
+			args:    []string{"aud=other-aud", "authorized_groups=baz"},
+			service: "sshd",
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "other-aud",
+				UserTemplates:    []string{`{{.Extra.email | trimSuffix "@example.com"}}`},
+				AuthorizedGroups: []string{"baz"},
+			},
+		},
+		{
+			name: "multiple issuers",
+			file: `
+user_template: '{{.Extra.email}}'
+authorized_groups: [foo]
+issuers:
+  - issuer: https://example.okta.com
+    aud: okta-aud
+    groups_claim_key: roles
+  - issuer: https://accounts.google.com
+    aud: google-aud
+    authorized_groups: [bar]
+`,
+			args: []string{"http_proxy=http://example.com:8080"},
+			want: &config{
+				UserTemplates:    []string{`{{.Extra.email}}`},
+				AuthorizedGroups: []string{"foo"},
+				HTTPProxy:        "http://example.com:8080",
+				Issuers: []*config{
+					{
+						Issuer:           "https://example.okta.com",
+						Aud:              "okta-aud",
+						UserTemplates:    []string{`{{.Extra.email}}`},
+						GroupsClaimKeys:  []string{"roles"},
+						AuthorizedGroups: []string{"foo"},
+						HTTPProxy:        "http://example.com:8080",
+					},
+					{
+						Issuer:           "https://accounts.google.com",
+						Aud:              "google-aud",
+						UserTemplates:    []string{`{{.Extra.email}}`},
+						AuthorizedGroups: []string{"bar"},
+						HTTPProxy:        "http://example.com:8080",
+					},
+				},
+			},
+		},
+		{
+			name: "arguments override issuer options",
+			file: `
+issuers:
+  - issuer: https://example.okta.com
+    aud: okta-aud
+    authorized_groups: [everyone]
+`,
+			args: []string{"authorized_groups=admins", "user_template={{.Subject}}"},
+			want: &config{
+				UserTemplates:    []string{"{{.Subject}}"},
+				AuthorizedGroups: []string{"admins"},
+				Issuers: []*config{
+					{
+						Issuer:           "https://example.okta.com",
+						Aud:              "okta-aud",
+						UserTemplates:    []string{"{{.Subject}}"},
+						AuthorizedGroups: []string{"admins"},
+					},
+				},
+			},
+		},
+		{
+			name: "profile issuers replace issuers",
+			file: `
+issuers:
+  - issuer: https://example.okta.com
+    aud: okta-aud
+profiles:
+  sshd:
+    issuers:
+      - issuer: https://accounts.google.com
+        aud: google-aud
+`,
+			service: "sshd",
+			want: &config{
+				Issuers: []*config{
+					{
+						Issuer: "https://accounts.google.com",
+						Aud:    "google-aud",
+					},
+				},
+			},
+		},
+		{
+			name: "service policies",
+			file: `
+issuer: https://example.com
+aud: example-aud
+authorized_groups: [engineering]
+policies:
+  - service: sshd
+    authorized_groups: [ssh-users]
+  - service: sudo
+    required_groups: [admins]
+    require_amr: mfa
+  - service: mysql*
+    user: 'app-*'
+    authorized_groups: [dba, app-owners]
+`,
+			want: &config{
+				Issuer:           "https://example.com",
+				Aud:              "example-aud",
+				AuthorizedGroups: []string{"engineering"},
+				Policies: []*servicePolicy{
+					{
+						Name:    "policies[0]",
+						Service: "sshd",
+						Config: &config{
+							Issuer:           "https://example.com",
+							Aud:              "example-aud",
+							AuthorizedGroups: []string{"ssh-users"},
+							Base: &config{
+								Issuer:           "https://example.com",
+								Aud:              "example-aud",
+								AuthorizedGroups: []string{"engineering"},
+							},
+						},
+					},
+					{
+						Name:    "policies[1]",
+						Service: "sudo",
+						Config: &config{
+							Issuer:         "https://example.com",
+							Aud:            "example-aud",
+							RequiredGroups: []string{"admins"},
+							RequireAMRs:    []string{"mfa"},
+							Base: &config{
+								Issuer:           "https://example.com",
+								Aud:              "example-aud",
+								AuthorizedGroups: []string{"engineering"},
+							},
+						},
+					},
+					{
+						Name:    "policies[2]",
+						Service: "mysql*",
+						User:    "app-*",
+						Config: &config{
+							Issuer:           "https://example.com",
+							Aud:              "example-aud",
+							AuthorizedGroups: []string{"dba", "app-owners"},
+							Base: &config{
+								Issuer:           "https://example.com",
+								Aud:              "example-aud",
+								AuthorizedGroups: []string{"engineering"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "service policies apply to issuers",
+			file: `
+issuers:
+  - issuer: https://example.okta.com
+    aud: okta-aud
+policies:
+  - service: sudo
+    require_acr: mfa
+`,
+			want: &config{
+				Issuers: []*config{
+					{
+						Issuer: "https://example.okta.com",
+						Aud:    "okta-aud",
+					},
+				},
+				Policies: []*servicePolicy{
+					{
+						Name:    "policies[0]",
+						Service: "sudo",
+						Config: &config{
+							RequireACRs: []string{"mfa"},
+							Base:        &config{},
+							Issuers: []*config{
+								{
+									Issuer:      "https://example.okta.com",
+									Aud:         "okta-aud",
+									RequireACRs: []string{"mfa"},
+									Base: &config{
+										Issuer: "https://example.okta.com",
+										Aud:    "okta-aud",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "policy without service",
+			file:    "policies:\n  - user: root\n    require_acr: mfa\n",
+			wantErr: "pam_oidc.yaml:2:5: policies[0]: missing required key: service",
+		},
+		{
+			name:    "non-authorization option in policy",
+			file:    "policies:\n  - service: sshd\n    issuer: https://example.com\n",
+			wantErr: "pam_oidc.yaml:3:13: policies[0].issuer: option cannot be set in a policy",
+		},
+		{
+			name:    "invalid option value in policy",
+			file:    "policies:\n  - service: sshd\n    max_auth_age: soon\n",
+			wantErr: "pam_oidc.yaml:3:19: policies[0].max_auth_age: invalid duration: soon",
+		},
+		{
+			name:    "invalid policy pattern",
+			file:    "policies:\n  - service: 'ss[hd'\n",
+			wantErr: "pam_oidc.yaml:2:14: policies[0].service: invalid pattern: syntax error in pattern",
+		},
+		{
+			name:    "unknown option in issuer",
+			file:    "issuers:\n  - issuer: https://example.com\n    invalid: foo\n",
+			wantErr: "pam_oidc.yaml:3:14: issuers[0].invalid: unknown option: invalid",
+		},
+		{
+			name:    "empty issuers",
+			file:    "issuers: []\n",
+			wantErr: "pam_oidc.yaml:1:10: issuers: expected a list of issuers",
+		},
+		{
+			name:    "unknown explicit profile",
+			file:    file,
+			args:    []string{"profile=invalid"},
+			wantErr: "unknown profile: invalid",
+		},
+		{
+			name:    "unknown option",
+			file:    "issuer: https://example.com\ninvalid: foo\n",
+			wantErr: "pam_oidc.yaml:2:10: invalid: unknown option: invalid",
+		},
+		{
+			name:    "unknown option in profile",
+			file:    "issuer: https://example.com\nprofiles:\n  sshd:\n    flow: invalid\n",
+			wantErr: "pam_oidc.yaml:4:11: profiles.sshd.flow: unknown flow: invalid",
+		},
+		{
+			name:    "duplicate option",
+			file:    "issuer: https://example.com\nissuer: https://example.org\n",
+			wantErr: "pam_oidc.yaml:2:1: issuer: duplicate key",
+		},
+		{
+			name:    "mapping option value",
+			file:    "issuer:\n  url: https://example.com\n",
+			wantErr: "pam_oidc.yaml:2:3: issuer: expected a string or list of strings",
+		},
+		{
+			name:    "not a mapping",
+			file:    "- issuer\n",
+			wantErr: "pam_oidc.yaml:1:1: expected a mapping of options",
+		},
+		{
+			name:    "malformed yaml",
+			file:    "issuer: [\n",
+			wantErr: "pam_oidc.yaml: yaml:",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pam_oidc.yaml")
+			if err := os.WriteFile(path, []byte(tc.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := configFromArgs(append([]string{"config=" + path}, tc.args...), tc.service)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("wanted no error, but got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("wanted error %v, but got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("wanted error %v, but got none", tc.wantErr)
+			}
+
+			if diff := cmp.Diff(config, tc.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestConfigFilePermissions(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		mode    os.FileMode
+		wantErr string
+	}{
+		{
+			name: "readable by others",
+			file: "issuer: https://example.com\n",
+			mode: 0644,
+		},
+		{
+			name:    "writable by others",
+			file:    "issuer: https://example.com\n",
+			mode:    0666,
+			wantErr: "must not be writable by group or others",
+		},
+		{
+			name:    "writable by group",
+			file:    "issuer: https://example.com\n",
+			mode:    0664,
+			wantErr: "must not be writable by group or others",
+		},
+		{
+			name:    "client secret readable by others",
+			file:    "issuer: https://example.com\nprofiles:\n  sshd:\n    client_secret: secret\n",
+			mode:    0644,
+			wantErr: "contains client_secret, so must not be readable by others",
+		},
+		{
+			name: "client secret readable by group",
+			file: "issuer: https://example.com\nclient_secret: secret\n",
+			mode: 0640,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pam_oidc.yaml")
+			if err := os.WriteFile(path, []byte(tc.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, tc.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := configFromArgs([]string{"config=" + path}, "sshd")
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("wanted no error, but got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("wanted error %v, but got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("wanted error %v, but got none", tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *config
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			config: &config{Issuer: "https://example.com", Aud: "example-aud"},
+		},
+		{
+			name:    "missing issuer",
+			config:  &config{Aud: "example-aud"},
+			wantErr: "missing required option: issuer",
+		},
+		{
+			name:    "missing aud",
+			config:  &config{Issuer: "https://example.com"},
+			wantErr: "missing required option: aud",
+		},
+		{
+			name:    "device flow missing client_id",
+			config:  &config{Issuer: "https://example.com", Aud: "example-aud", Flow: flowDevice},
+			wantErr: "missing required option for device flow: client_id",
+		},
+		{
+			name:    "user map mode only missing user_map_file",
+			config:  &config{Issuer: "https://example.com", Aud: "example-aud", UserMapMode: userMapOnly},
+			wantErr: "missing required option for user map mode only: user_map_file",
+		},
+		{
+			name:    "client certificate missing client_key_file",
+			config:  &config{Issuer: "https://example.com", Aud: "example-aud", ClientCertFile: "/etc/pam_oidc/client.pem"},
+			wantErr: "missing required option for client certificate: client_key_file",
+		},
+		{
+			name:    "client key missing client_cert_file",
+			config:  &config{Issuer: "https://example.com", Aud: "example-aud", ClientKeyFile: "/etc/pam_oidc/client.key"},
+			wantErr: "missing required option for client key: client_cert_file",
+		},
+		{
+			name: "multiple issuers",
+			config: &config{Issuers: []*config{
+				{Issuer: "https://example.okta.com", Aud: "okta-aud"},
+				{Issuer: "https://accounts.google.com", Aud: "google-aud"},
+			}},
+		},
+		{
+			name: "multiple issuers missing aud",
+			config: &config{Issuers: []*config{
+				{Issuer: "https://example.okta.com", Aud: "okta-aud"},
+				{Issuer: "https://accounts.google.com"},
+			}},
+			wantErr: "issuers[1]: missing required option: aud",
+		},
+		{
+			name: "multiple issuers duplicate issuer",
+			config: &config{Issuers: []*config{
+				{Issuer: "https://example.okta.com", Aud: "okta-aud"},
+				{Issuer: "https://example.okta.com", Aud: "other-aud"},
+			}},
+			wantErr: "issuers[1]: duplicate issuer: https://example.okta.com",
+		},
+		{
+			name: "multiple issuers with device flow",
+			config: &config{Flow: flowDevice, Issuers: []*config{
+				{Issuer: "https://example.okta.com", Aud: "okta-aud", Flow: flowDevice, ClientID: "client"},
+			}},
+			wantErr: "device flow requires a single issuer",
+		},
+		{
+			name: "multiple issuers with token introspection",
+			config: &config{Issuers: []*config{
+				{Issuer: "https://example.okta.com", Aud: "okta-aud", TokenType: tokenTypeIntrospect, ClientID: "client"},
+			}},
+			wantErr: "issuers[0]: token introspection requires a single issuer",
+		},
+		{
+			name:    "token introspection missing client_id",
+			config:  &config{Issuer: "https://example.com", Aud: "example-aud", TokenType: tokenTypeIntrospect},
+			wantErr: "missing required option for token introspection: client_id",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if err != nil && tc.wantErr == "" {
+				t.Errorf("wanted no error, but got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("wanted error %v, but got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Errorf("wanted error %v, but got none", tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigForRequest(t *testing.T) {
+	sshd := &servicePolicy{Name: "policies[0]", Service: "sshd", Config: &config{AuthorizedGroups: []string{"ssh-users"}}}
+	appDB := &servicePolicy{Name: "policies[1]", Service: "mysql*", User: "app-*", Config: &config{AuthorizedGroups: []string{"app-owners"}}}
+	db := &servicePolicy{Name: "policies[2]", Service: "mysql*", Config: &config{AuthorizedGroups: []string{"dba"}}}
+	c := &config{
+		AuthorizedGroups: []string{"engineering"},
+		Policies:         []*servicePolicy{sshd, appDB, db},
+	}
+
+	cases := []struct {
+		service    string
+		user       string
+		wantPolicy *servicePolicy
+	}{
+		{service: "sshd", user: "jdoe", wantPolicy: sshd},
+		{service: "mysqld", user: "app-billing", wantPolicy: appDB},
+		{service: "mysqld", user: "root", wantPolicy: db},
+		{service: "mysql-admin", user: "root", wantPolicy: db},
+		{service: "sudo", user: "root"},
+	}
+
+	for _, tc := range cases {
+		got, policy := c.forRequest(tc.service, tc.user)
+		if policy != tc.wantPolicy {
+			t.Errorf("%s %s: want policy %v, got %v", tc.service, tc.user, tc.wantPolicy, policy)
+		}
+
+		want := c
+		if tc.wantPolicy != nil {
+			want = tc.wantPolicy.Config
+		}
+		if got != want {
+			t.Errorf("%s %s: want config %v, got %v", tc.service, tc.user, want, got)
+		}
+	}
+}
+
+func TestConfigForIssuer(t *testing.T) {
+	single := &config{Issuer: "https://example.com", Aud: "example-aud"}
+	if got, err := single.forIssuer("https://other.example.com"); err != nil || got != single {
+		t.Errorf("want single issuer config, got %v, %v", got, err)
+	}
+
+	okta := &config{Issuer: "https://example.okta.com", Aud: "okta-aud"}
+	google := &config{Issuer: "https://accounts.google.com", Aud: "google-aud"}
+	multiple := &config{Issuers: []*config{okta, google}}
+
+	if got, err := multiple.forIssuer("https://accounts.google.com"); err != nil || got != google {
+		t.Errorf("want google config, got %v, %v", got, err)
+	}
+	if _, err := multiple.forIssuer("https://evil.example.com"); err == nil || !strings.Contains(err.Error(), `issuer "https://evil.example.com" is not trusted`) {
+		t.Errorf("want untrusted issuer err, got %v", err)
+	}
+}
+
+func TestConfigSetAuthorization(t *testing.T) {
+	c, err := configFromArgs([]string{
+		"issuer=https://example.com",
+		"aud=example-aud",
+		"groups_claim_key=roles",
+		"authorized_groups=eng",
+		"required_groups=employees",
+		"denied_groups=suspended",
+		"allowed_networks=10.0.0.0/8",
+		"denied_networks=10.66.0.0/16",
+		"group_networks=contractors@10.8.0.0/16",
+		"group_hours=contractors@mon-fri/09:00-17:00/UTC",
+		"access_starts_claim=jit.starts",
+		"access_expires_claim=jit.expires",
+		"require_acrs=mfa",
+		"require_amr=hwk",
+		"require_all_amr=pwd,otp",
+		"require_claim=email_verified",
+		"policy=claims.sub != ''",
+		"disabled_claim_key=disabled",
+	}, "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := policyRequest{Service: "sshd", User: "jdoe"}
+
+	// Every authorization option is checked in both phases, so must be set
+	got := &authenticator{}
+	c.setAuthorization(got, request)
+
+	want := &authenticator{
+		GroupsClaimKeys:    []string{"roles"},
+		AuthorizedGroups:   []string{"eng"},
+		RequiredGroups:     []string{"employees"},
+		DeniedGroups:       []string{"suspended"},
+		AllowedNetworks:    []string{"10.0.0.0/8"},
+		DeniedNetworks:     []string{"10.66.0.0/16"},
+		GroupNetworks:      []string{"contractors@10.8.0.0/16"},
+		GroupHours:         []string{"contractors@mon-fri/09:00-17:00/UTC"},
+		AccessStartsClaim:  "jit.starts",
+		AccessExpiresClaim: "jit.expires",
+		RequireACRs:        []string{"mfa"},
+		RequireAMRs:        []string{"hwk"},
+		RequireAllAMRs:     []string{"pwd", "otp"},
+		RequireClaims:      []string{"email_verified"},
+		Policy:             "claims.sub != ''",
+		Request:            request,
+		DisabledClaimKey:   "disabled",
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(authenticator{})); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
+func TestConfigPolicyAuthorization(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pam_oidc.yaml")
+	if err := os.WriteFile(path, []byte(`
+issuer: https://example.com
+aud: example-aud
+authorized_groups: [engineering]
+require_claim: email_verified
+max_token_age: 10m
+policies:
+  - service: sshd
+    authorized_groups: [ssh-users]
+    max_token_age: 1h
+  - service: sudo
+    max_auth_age: 5m
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := configFromArgs([]string{"config=" + path}, "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshd, _ := c.forRequest("sshd", "jdoe")
+	if sshd.MaxTokenAge != 10*time.Minute {
+		t.Errorf("want the shorter max_token_age of 10m, got %v", sshd.MaxTokenAge)
+	}
+	sudo, _ := c.forRequest("sudo", "jdoe")
+	if sudo.MaxTokenAge != 10*time.Minute || sudo.MaxAuthAge != 5*time.Minute {
+		t.Errorf("want max_token_age 10m and max_auth_age 5m, got %v and %v", sudo.MaxTokenAge, sudo.MaxAuthAge)
+	}
+
+	// The global options are checked as well as those of the policy
+	cases := []struct {
+		name    string
+		groups  []interface{}
+		extra   map[string]interface{}
+		wantErr error
+	}{
+		{
+			name:   "policy and global groups",
+			groups: []interface{}{"engineering", "ssh-users"},
+		},
+		{
+			name:    "policy group only",
+			groups:  []interface{}{"ssh-users"},
+			wantErr: ErrGroupDenied,
+		},
+		{
+			name:    "global group only",
+			groups:  []interface{}{"engineering"},
+			wantErr: ErrGroupDenied,
+		},
+		{
+			name:    "global claim rule not satisfied",
+			groups:  []interface{}{"engineering", "ssh-users"},
+			extra:   map[string]interface{}{"email_verified": false},
+			wantErr: ErrClaimDenied,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &oidc.Claims{Extra: map[string]interface{}{
+				"groups":         tc.groups,
+				"email_verified": true,
+			}}
+			for k, v := range tc.extra {
+				claims.Extra[k] = v
+			}
+
+			a := &authenticator{}
+			sshd.setAuthorization(a, policyRequest{Service: "sshd", User: "jdoe"})
+			err := a.authorize(claims)
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("wanted no error, but got %v", err)
+			} else if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Fatalf("wanted error %v, but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	// defaultDeviceInterval is the polling interval used when the
+	// authorization server does not specify one.
+	defaultDeviceInterval = 5 * time.Second
+
+	// defaultDeviceExpiry is how long to wait for the user to complete
+	// authorization when the authorization server does not specify when the
+	// device code expires.
+	defaultDeviceExpiry = 10 * time.Minute
+)
+
+// deviceFlow obtains an ID token using the OAuth 2.0 Device Authorization
+// Grant (RFC 8628).
+type deviceFlow struct {
+	// ClientID is the OAuth 2.0 client ID.
+	ClientID string
+
+	// ClientSecret is the OAuth 2.0 client secret. If empty, the client is
+	// treated as a public client.
+	ClientSecret string
+
+	// Scopes are the scopes requested. `openid` is used by default if not set.
+	Scopes []string
+
+	httpClient                  *http.Client
+	deviceAuthorizationEndpoint string
+	tokenEndpoint               string
+
+	// sleep waits for d or until ctx is done. sleepContext is used by default.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// deviceAuthorization is the device authorization response.
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Message returns the instructions shown to the user.
+func (d *deviceAuthorization) Message() string {
+	if d.VerificationURIComplete != "" {
+		return fmt.Sprintf("To sign in, visit %s and confirm code %s", d.VerificationURIComplete, d.UserCode)
+	}
+
+	return fmt.Sprintf("To sign in, visit %s and enter code %s", d.VerificationURI, d.UserCode)
+}
+
+// tokenErrorResponse is an OAuth 2.0 error response.
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// deviceFlowToken obtains an ID token with the device flow for the issuer of
+// cfg, showing the user code with info.
+func deviceFlowToken(ctx context.Context, cfg *config, info func(msg string) error) (string, error) {
+	p, err := cfg.provider()
+	if err != nil {
+		return "", err
+	}
+
+	flow, err := discoverDeviceFlow(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	flow.ClientID = cfg.ClientID
+	flow.ClientSecret = cfg.ClientSecret
+	flow.Scopes = cfg.Scopes
+
+	auth, err := flow.Authorize(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if err := info(auth.Message()); err != nil {
+		return "", fmt.Errorf("showing user code: %v", err)
+	}
+
+	return flow.Token(ctx, auth)
+}
+
+func discoverDeviceFlow(ctx context.Context, p *provider) (*deviceFlow, error) {
+	md, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering device flow: %w", err)
+	}
+
+	if md.DeviceAuthorizationEndpoint == "" {
+		return nil, errors.New("issuer does not support the device authorization grant")
+	} else if md.TokenEndpoint == "" {
+		return nil, errors.New("issuer has no token endpoint")
+	}
+
+	return &deviceFlow{
+		httpClient:                  p.httpClient,
+		deviceAuthorizationEndpoint: md.DeviceAuthorizationEndpoint,
+		tokenEndpoint:               md.TokenEndpoint,
+	}, nil
+}
+
+// Authorize starts the device flow, returning the code the user must enter at
+// the verification URI.
+func (d *deviceFlow) Authorize(ctx context.Context) (*deviceAuthorization, error) {
+	scopes := []string{"openid"}
+	if len(d.Scopes) > 0 {
+		scopes = d.Scopes
+	}
+
+	form := url.Values{}
+	form.Set("scope", strings.Join(scopes, " "))
+
+	resp, err := d.post(ctx, d.deviceAuthorizationEndpoint, form)
+	if err != nil {
+		return nil, authErrorf(reasonDiscovery, "requesting device authorization: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, authErrorf(reasonDiscovery, "requesting device authorization: %v", tokenError(resp))
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting device authorization: %v", tokenError(resp))
+	}
+
+	auth := new(deviceAuthorization)
+	if err := json.NewDecoder(resp.Body).Decode(auth); err != nil {
+		return nil, fmt.Errorf("decoding device authorization: %v", err)
+	}
+
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, errors.New("device authorization response is missing required fields")
+	}
+
+	return auth, nil
+}
+
+// Token polls the token endpoint until the user completes authorization,
+// returning the ID token.
+func (d *deviceFlow) Token(ctx context.Context, auth *deviceAuthorization) (string, error) {
+	sleep := sleepContext
+	if d.sleep != nil {
+		sleep = d.sleep
+	}
+
+	interval := defaultDeviceInterval
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * time.Second
+	}
+
+	// Polling is always bounded, so an issuer that omits expires_in cannot
+	// hold up the login indefinitely.
+	expiry := defaultDeviceExpiry
+	if auth.ExpiresIn > 0 {
+		expiry = time.Duration(auth.ExpiresIn) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, expiry)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("grant_type", deviceCodeGrantType)
+	form.Set("device_code", auth.DeviceCode)
+
+	for {
+		if err := sleep(ctx, interval); err != nil {
+			return "", fmt.Errorf("waiting for authorization: %v", err)
+		}
+
+		token, pending, err := d.pollToken(ctx, form)
+		if err != nil {
+			return "", err
+		} else if token != "" {
+			return token, nil
+		}
+
+		if pending == "slow_down" {
+			interval += 5 * time.Second
+		}
+	}
+}
+
+// pollToken makes a single token request. If authorization is still pending,
+// the error code returned by the server is returned.
+func (d *deviceFlow) pollToken(ctx context.Context, form url.Values) (token string, pending string, err error) {
+	resp, err := d.post(ctx, d.tokenEndpoint, form)
+	if err != nil && ctx.Err() != nil {
+		// The device code expired while waiting for the response
+		return "", "", fmt.Errorf("requesting token: %v", err)
+	} else if err != nil {
+		return "", "", authErrorf(reasonDiscovery, "requesting token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", "", authErrorf(reasonDiscovery, "requesting token: %v", tokenError(resp))
+	} else if resp.StatusCode != http.StatusOK {
+		terr := tokenError(resp)
+		if terr.Error == "authorization_pending" || terr.Error == "slow_down" {
+			return "", terr.Error, nil
+		}
+
+		return "", "", fmt.Errorf("requesting token: %v", terr)
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", "", fmt.Errorf("decoding token response: %v", err)
+	}
+
+	if tok.IDToken == "" {
+		return "", "", errors.New("token response is missing id_token")
+	}
+
+	return tok.IDToken, "", nil
+}
+
+func (d *deviceFlow) post(ctx context.Context, endpoint string, form url.Values) (*http.Response, error) {
+	return postForm(ctx, d.httpClient, endpoint, d.ClientID, d.ClientSecret, form)
+}
+
+// postForm posts form to endpoint, authenticating as the client. Confidential
+// clients authenticate with HTTP basic authentication, public clients by
+// including client_id in the form.
+func postForm(ctx context.Context, hc *http.Client, endpoint string, clientID string, clientSecret string, form url.Values) (*http.Response, error) {
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	return hc.Do(req)
+}
+
+// tokenError decodes an OAuth 2.0 error response. If the body is not a valid
+// error response, the HTTP status is used as the error.
+func tokenError(resp *http.Response) *tokenErrorResponse {
+	terr := new(tokenErrorResponse)
+	if err := json.NewDecoder(resp.Body).Decode(terr); err != nil || terr.Error == "" {
+		return &tokenErrorResponse{Error: resp.Status}
+	}
+
+	return terr
+}
+
+func (t *tokenErrorResponse) String() string {
+	if t.ErrorDescription != "" {
+		return fmt.Sprintf("%s: %s", t.Error, t.ErrorDescription)
+	}
+
+	return t.Error
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"github.com/pardot/oidc/signer"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	cases := []struct {
+		name          string
+		tokenErrors   []string
+		clientSecret  string
+		wantIntervals []time.Duration
+		wantErr       string
+	}{
+		{
+			name:          "authorized immediately",
+			wantIntervals: []time.Duration{1 * time.Second},
+		},
+		{
+			name:          "authorization pending",
+			tokenErrors:   []string{"authorization_pending", "authorization_pending"},
+			wantIntervals: []time.Duration{1 * time.Second, 1 * time.Second, 1 * time.Second},
+		},
+		{
+			name:          "slow down",
+			tokenErrors:   []string{"slow_down"},
+			wantIntervals: []time.Duration{1 * time.Second, 6 * time.Second},
+		},
+		{
+			name:          "confidential client",
+			clientSecret:  "example-secret",
+			wantIntervals: []time.Duration{1 * time.Second},
+		},
+		{
+			name:        "access denied",
+			tokenErrors: []string{"authorization_pending", "access_denied"},
+			wantErr:     "access_denied",
+		},
+		{
+			name:        "expired token",
+			tokenErrors: []string{"expired_token"},
+			wantErr:     "expired_token",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			issuer := newTestIssuer(t)
+			issuer.tokenErrors = tc.tokenErrors
+			issuer.clientSecret = tc.clientSecret
+
+			flow, err := discoverDeviceFlow(ctx, issuer.provider())
+			if err != nil {
+				t.Fatal(err)
+			}
+			flow.ClientID = "valid-aud"
+			flow.ClientSecret = tc.clientSecret
+
+			var intervals []time.Duration
+			flow.sleep = func(ctx context.Context, d time.Duration) error {
+				intervals = append(intervals, d)
+				return nil
+			}
+
+			auth, err := flow.Authorize(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := "To sign in, visit " + issuer.srv.URL + "/activate and enter code ABCD-EFGH"; auth.Message() != want {
+				t.Errorf("want message %q, got %q", want, auth.Message())
+			}
+
+			token, err := flow.Token(ctx, auth)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if tc.wantErr != "" {
+				return
+			}
+
+			if len(intervals) != len(tc.wantIntervals) {
+				t.Errorf("want intervals %v, got %v", tc.wantIntervals, intervals)
+			}
+			for i := range intervals {
+				if i < len(tc.wantIntervals) && intervals[i] != tc.wantIntervals[i] {
+					t.Errorf("want intervals %v, got %v", tc.wantIntervals, intervals)
+					break
+				}
+			}
+
+			// The token from the device flow authenticates against the same issuer
+			authn, err := discoverAuthenticator(ctx, issuer.provider(), "valid-aud")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := authn.Authenticate(ctx, "jdoe", token); err != nil {
+				t.Errorf("want no err, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeviceFlowUnsupported(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.noDeviceFlow = true
+
+	_, err := discoverDeviceFlow(context.Background(), issuer.provider())
+	if err == nil || !strings.Contains(err.Error(), "does not support the device authorization grant") {
+		t.Errorf("want unsupported err, got %v", err)
+	}
+}
+
+func TestDeviceFlowDefaultExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+
+	flow, err := discoverDeviceFlow(ctx, issuer.provider())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without expires_in, polling is still bounded
+	var deadline time.Time
+	flow.sleep = func(ctx context.Context, d time.Duration) error {
+		var ok bool
+		if deadline, ok = ctx.Deadline(); !ok {
+			t.Error("want polling to have a deadline, got none")
+		}
+		return context.DeadlineExceeded
+	}
+
+	start := time.Now()
+	if _, err := flow.Token(ctx, &deviceAuthorization{DeviceCode: "device-code"}); err == nil {
+		t.Fatal("want err, got none")
+	}
+	if max := start.Add(defaultDeviceExpiry + time.Minute); deadline.After(max) {
+		t.Errorf("want deadline before %v, got %v", max, deadline)
+	}
+}
+
+func TestDeviceFlowTokenUnavailable(t *testing.T) {
+	cases := []struct {
+		name string
+		// unavailable makes the issuer unavailable from the start, rather
+		// than once the user code is shown.
+		unavailable bool
+	}{
+		{
+			name:        "discovery",
+			unavailable: true,
+		},
+		{
+			name: "token polling",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newTestIssuer(t)
+			issuer.unavailable = tc.unavailable
+
+			retries := 0
+			cfg := &config{
+				Issuer:      issuer.srv.URL,
+				ClientID:    "valid-aud",
+				HTTPRetries: &retries,
+			}
+
+			_, err := deviceFlowToken(context.Background(), cfg, func(msg string) error {
+				issuer.unavailable = true
+				return nil
+			})
+
+			// Mirror pam_sm_authenticate_go
+			err = authErrorf(reasonDeviceFlow, "failed to obtain token with device flow: %w", err)
+			if !errors.Is(err, ErrDiscoveryFailed) {
+				t.Errorf("want err %v, got %v", ErrDiscoveryFailed, err)
+			}
+			if code := authenticateCode(err); code != pamAuthInfoUnavail {
+				t.Errorf("want code %v, got %v", pamAuthInfoUnavail, code)
+			}
+		})
+	}
+}
+
+// testIssuer is a local stand-in for an OpenID Connect issuer.
+type testIssuer struct {
+	srv    *httptest.Server
+	signer *signer.StaticSigner
+
+	// clientSecret, if set, is required by the token endpoint.
+	clientSecret string
+	// tokenErrors are returned, in order, by the token endpoint before a token
+	// is issued.
+	tokenErrors []string
+	// noDeviceFlow omits the device authorization endpoint from discovery.
+	noDeviceFlow bool
+	// introspection maps tokens to their introspection responses. Unknown
+	// tokens are inactive.
+	introspection map[string]map[string]interface{}
+	// cacheControl, if set, is the Cache-Control header of discovery and key
+	// responses.
+	cacheControl string
+	// unavailable makes every endpoint fail, as if the issuer were down.
+	unavailable bool
+	// failures is the number of requests that fail, as if the issuer were
+	// briefly down, before it recovers.
+	failures int
+	// delay is how long the issuer takes to respond, unless the request is
+	// canceled first.
+	delay time.Duration
+	// requests counts requests by path.
+	requests map[string]int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	signingKey := jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key: jose.JSONWebKey{
+			Key:       testKey,
+			KeyID:     "test-key",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		},
+	}
+	verificationKeys := []jose.JSONWebKey{
+		{
+			Key:       testKey.Public(),
+			KeyID:     "test-key",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		},
+	}
+
+	ti := &testIssuer{
+		signer:   signer.NewStatic(signingKey, verificationKeys),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(wellKnownConfiguration, func(w http.ResponseWriter, r *http.Request) {
+		md := map[string]string{
+			"issuer":                 ti.srv.URL,
+			"jwks_uri":               ti.srv.URL + "/keys",
+			"token_endpoint":         ti.srv.URL + "/token",
+			"introspection_endpoint": ti.srv.URL + "/introspect",
+		}
+		if !ti.noDeviceFlow {
+			md["device_authorization_endpoint"] = ti.srv.URL + "/device"
+		}
+		_ = json.NewEncoder(w).Encode(md)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: verificationKeys})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("scope") != "openid" {
+			http.Error(w, "invalid scope", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": ti.srv.URL + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			clientID = r.PostFormValue("client_id")
+		}
+		if clientID != "valid-aud" || clientSecret != ti.clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if r.PostFormValue("grant_type") != deviceCodeGrantType || r.PostFormValue("device_code") != "device-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		if len(ti.tokenErrors) > 0 {
+			terr := ti.tokenErrors[0]
+			ti.tokenErrors = ti.tokenErrors[1:]
+
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": terr})
+			return
+		}
+
+		now := time.Now()
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token": mustJWT(t, ti.signer, oidc.Claims{
+				Issuer:    ti.srv.URL,
+				Subject:   "jdoe",
+				Audience:  []string{"valid-aud"},
+				Expiry:    oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				NotBefore: oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				IssuedAt:  oidc.UnixTime(now.Unix()),
+			}),
+		})
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "valid-aud" || clientSecret != ti.clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		resp, ok := ti.introspection[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]interface{}{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	ti.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ti.requests[r.URL.Path]++
+		if ti.delay > 0 {
+			select {
+			case <-time.After(ti.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if ti.unavailable || ti.failures > 0 {
+			ti.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if ti.cacheControl != "" {
+			w.Header().Set("Cache-Control", ti.cacheControl)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ti.srv.Close)
+
+	return ti
+}
+
+// provider returns a provider for the issuer, without a cache.
+func (ti *testIssuer) provider() *provider {
+	return newProvider(ti.srv.Client(), ti.srv.URL, nil)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pardot/oidc"
+)
+
+// envNameRegexp matches valid environment variable names.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envVar is an environment variable exported to the PAM environment, whose
+// value is rendered from the verified claims.
+type envVar struct {
+	Name string
+	// Template is a template that is rendered with the claims to produce the
+	// value.
+	Template string
+}
+
+// parseEnvVar parses an environment variable of the form NAME=template.
+func parseEnvVar(value string) (envVar, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return envVar{}, fmt.Errorf("malformed environment variable, expected NAME=template: %v", value)
+	} else if !envNameRegexp.MatchString(parts[0]) {
+		return envVar{}, fmt.Errorf("invalid environment variable name: %v", parts[0])
+	}
+
+	return envVar{Name: parts[0], Template: parts[1]}, nil
+}
+
+// missingValue is what templates render for a claim that is absent.
+const missingValue = "<no value>"
+
+// renderEnv renders vars with claims, returning NAME=value pairs. Claims that
+// are absent are rendered as empty strings.
+func renderEnv(vars []envVar, claims *oidc.Claims) ([]string, error) {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		value, err := renderClaimsTemplate(v.Template, claims)
+		if err != nil {
+			return nil, fmt.Errorf("rendering %s: %v", v.Name, err)
+		}
+		value = strings.ReplaceAll(value, missingValue, "")
+
+		// Claims are controlled by the issuer, so must not be able to smuggle
+		// additional lines or variables into the environment
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("rendering %s: value contains control characters", v.Name)
+		}
+
+		env = append(env, v.Name+"="+value)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestRenderEnv(t *testing.T) {
+	claims := &oidc.Claims{
+		Issuer:  "https://accounts.google.com",
+		Subject: "110169484474386276334",
+		Extra: map[string]interface{}{
+			"email":  "jdoe@example.com",
+			"groups": []interface{}{"admins", "developers"},
+			"name":   "Jane\nDoe",
+		},
+	}
+
+	cases := []struct {
+		name    string
+		env     []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "identity",
+			env: []string{
+				"OIDC_SUBJECT={{.Subject}}",
+				"OIDC_EMAIL={{.Extra.email}}",
+				`OIDC_GROUPS={{.Extra.groups | join ","}}`,
+				"OIDC_ISSUER={{.Issuer}}",
+			},
+			want: []string{
+				"OIDC_SUBJECT=110169484474386276334",
+				"OIDC_EMAIL=jdoe@example.com",
+				"OIDC_GROUPS=admins,developers",
+				"OIDC_ISSUER=https://accounts.google.com",
+			},
+		},
+		{
+			name: "value containing equals sign",
+			env:  []string{"OIDC_USER=user={{.Extra.email}}"},
+			want: []string{"OIDC_USER=user=jdoe@example.com"},
+		},
+		{
+			name: "missing claim",
+			env:  []string{"OIDC_ROLES={{with .Extra.roles}}{{join \",\" .}}{{end}}"},
+			want: []string{"OIDC_ROLES="},
+		},
+		{
+			name: "missing claims without with",
+			env: []string{
+				"OIDC_PHONE={{.Extra.phone_number}}",
+				`OIDC_ROLES={{.Extra.roles | join ","}}`,
+				"OIDC_LABEL=phone:{{.Extra.phone_number}}",
+			},
+			want: []string{
+				"OIDC_PHONE=",
+				"OIDC_ROLES=",
+				"OIDC_LABEL=phone:",
+			},
+		},
+		{
+			name:    "control characters",
+			env:     []string{"OIDC_NAME={{.Extra.name}}"},
+			wantErr: "rendering OIDC_NAME: value contains control characters",
+		},
+		{
+			name:    "invalid template",
+			env:     []string{"OIDC_NAME={{.Extra.name"},
+			wantErr: "rendering OIDC_NAME: parsing template",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var vars []envVar
+			for _, e := range tc.env {
+				v, err := parseEnvVar(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vars = append(vars, v)
+			}
+
+			env, err := renderEnv(vars, claims)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if diff := cmp.Diff(tc.want, env); tc.wantErr == "" && diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestRenderEnvREADME(t *testing.T) {
+	// The examples from the README, for a token with only the required claims
+	claims := &oidc.Claims{
+		Issuer:  "https://accounts.google.com",
+		Subject: "110169484474386276334",
+	}
+
+	var vars []envVar
+	for _, e := range []string{
+		"OIDC_SUBJECT={{.Subject}}",
+		"OIDC_EMAIL={{.Extra.email}}",
+		"OIDC_ISSUER={{.Issuer}}",
+		`OIDC_GROUPS={{.Extra.groups | join ","}}`,
+	} {
+		v, err := parseEnvVar(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars = append(vars, v)
+	}
+
+	env, err := renderEnv(vars, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"OIDC_SUBJECT=110169484474386276334",
+		"OIDC_EMAIL=",
+		"OIDC_ISSUER=https://accounts.google.com",
+		"OIDC_GROUPS=",
+	}
+	if diff := cmp.Diff(want, env); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestParseEnvVar(t *testing.T) {
+	for _, value := range []string{"OIDC_SUBJECT", "=value", "1OIDC={{.Subject}}", "OIDC SUBJECT={{.Subject}}"} {
+		if _, err := parseEnvVar(value); err == nil {
+			t.Errorf("%q: want err, got none", value)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reasonCode is a stable, machine-readable reason for a failed decision,
+// recorded in audit records.
+type reasonCode string
+
+const (
+	reasonInternal        reasonCode = "internal_error"
+	reasonPAM             reasonCode = "pam_error"
+	reasonConfig          reasonCode = "config_error"
+	reasonDiscovery       reasonCode = "discovery_failed"
+	reasonDeviceFlow      reasonCode = "device_flow_failed"
+	reasonUntrustedIssuer reasonCode = "untrusted_issuer"
+	reasonInvalidToken    reasonCode = "invalid_token"
+	reasonTokenExpired    reasonCode = "token_expired"
+	reasonBadSignature    reasonCode = "bad_signature"
+	reasonTokenTooOld     reasonCode = "token_too_old"
+	reasonTokenReplayed   reasonCode = "token_replayed"
+	reasonReplayCache     reasonCode = "replay_cache_error"
+	reasonUserTemplate    reasonCode = "user_template_error"
+	reasonUserMismatch    reasonCode = "user_mismatch"
+	reasonGroupDenied     reasonCode = "group_denied"
+	reasonACRDenied       reasonCode = "acr_denied"
+	reasonAMRDenied       reasonCode = "amr_denied"
+	reasonClaimDenied     reasonCode = "claim_denied"
+	reasonNetworkDenied   reasonCode = "network_denied"
+	reasonTimeDenied      reasonCode = "time_denied"
+	reasonPolicyDenied    reasonCode = "policy_denied"
+	reasonAccountExpired  reasonCode = "account_expired"
+	reasonAccountDisabled reasonCode = "account_disabled"
+)
+
+// Errors that authentication failures can be matched against with errors.Is.
+var (
+	// ErrUserMismatch is returned when the token is for a different user.
+	ErrUserMismatch = errors.New("user mismatch")
+	// ErrGroupDenied is returned when the user is not a member of an
+	// authorized group.
+	ErrGroupDenied = errors.New("group denied")
+	// ErrACRDenied is returned when the token does not have a required acr.
+	ErrACRDenied = errors.New("acr denied")
+	// ErrAMRDenied is returned when the token does not have the required amr
+	// values.
+	ErrAMRDenied = errors.New("amr denied")
+	// ErrClaimDenied is returned when the token does not satisfy a required
+	// claim rule.
+	ErrClaimDenied = errors.New("claim denied")
+	// ErrNetworkDenied is returned when the remote host is not in a network
+	// allowed.
+	ErrNetworkDenied = errors.New("network denied")
+	// ErrTimeDenied is returned when access is not allowed at the current
+	// time.
+	ErrTimeDenied = errors.New("time denied")
+	// ErrPolicyDenied is returned when the policy does not allow access.
+	ErrPolicyDenied = errors.New("policy denied")
+	// ErrTokenExpired is returned when the token has expired.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrBadSignature is returned when the token is not signed by a key of the
+	// issuer.
+	ErrBadSignature = errors.New("bad signature")
+	// ErrDiscoveryFailed is returned when the issuer cannot be reached to
+	// discover its configuration and keys, or to validate the token.
+	ErrDiscoveryFailed = errors.New("discovery failed")
+)
+
+// reasonErrors are the errors matched by authErrors with each reason.
+var reasonErrors = map[reasonCode]error{
+	reasonUserMismatch:  ErrUserMismatch,
+	reasonGroupDenied:   ErrGroupDenied,
+	reasonACRDenied:     ErrACRDenied,
+	reasonAMRDenied:     ErrAMRDenied,
+	reasonClaimDenied:   ErrClaimDenied,
+	reasonNetworkDenied: ErrNetworkDenied,
+	reasonTimeDenied:    ErrTimeDenied,
+	reasonPolicyDenied:  ErrPolicyDenied,
+	reasonTokenExpired:  ErrTokenExpired,
+	reasonBadSignature:  ErrBadSignature,
+	reasonDiscovery:     ErrDiscoveryFailed,
+}
+
+// authError is an error with the reason for the failure.
+type authError struct {
+	reason reasonCode
+	err    error
+}
+
+// authErrorf returns an authError for reason, formatting the message like
+// fmt.Errorf.
+func authErrorf(reason reasonCode, format string, a ...interface{}) error {
+	return &authError{
+		reason: reason,
+		err:    fmt.Errorf(format, a...),
+	}
+}
+
+func (e *authError) Error() string {
+	return e.err.Error()
+}
+
+func (e *authError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is the error for the reason of e.
+func (e *authError) Is(target error) bool {
+	reasonErr, ok := reasonErrors[e.reason]
+	return ok && reasonErr == target
+}
+
+// failureReason returns the reason for err, or reasonInternal if it has none.
+func failureReason(err error) reasonCode {
+	var aerr *authError
+	if errors.As(err, &aerr) {
+		return aerr.reason
+	}
+
+	return reasonInternal
+}
+
+// pamCode is a PAM return code. It is independent of the PAM headers, so the
+// mapping from errors can be tested without them.
+type pamCode int
+
+const (
+	pamSuccess pamCode = iota
+	pamAuthErr
+	pamAuthInfoUnavail
+	pamUserUnknown
+	pamPermDenied
+	pamAcctExpired
+	pamServiceErr
+	pamSystemErr
+)
+
+// authenticateCode returns the PAM return code of the authentication phase for
+// err.
+func authenticateCode(err error) pamCode {
+	switch {
+	case err == nil:
+		return pamSuccess
+	case errors.Is(err, ErrDiscoveryFailed):
+		return pamAuthInfoUnavail
+	case errors.Is(err, ErrUserMismatch):
+		return pamUserUnknown
+	case errors.Is(err, ErrGroupDenied), errors.Is(err, ErrACRDenied), errors.Is(err, ErrAMRDenied), errors.Is(err, ErrClaimDenied), errors.Is(err, ErrNetworkDenied), errors.Is(err, ErrTimeDenied), errors.Is(err, ErrPolicyDenied):
+		return pamPermDenied
+	}
+
+	switch failureReason(err) {
+	case reasonConfig, reasonUserTemplate:
+		return pamServiceErr
+	case reasonPAM, reasonReplayCache:
+		return pamSystemErr
+	default:
+		return pamAuthErr
+	}
+}
+
+// accountCode returns the PAM return code of the account management phase for
+// err.
+func accountCode(err error) pamCode {
+	switch {
+	case err == nil:
+		return pamSuccess
+	case errors.Is(err, errAccountExpired):
+		return pamAcctExpired
+	case errors.Is(err, ErrUserMismatch):
+		return pamUserUnknown
+	default:
+		return pamPermDenied
+	}
+}
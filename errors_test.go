@@ -0,0 +1,351 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+	"github.com/pardot/oidc/signer"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestAuthenticateCode(t *testing.T) {
+	now := time.Now()
+
+	// otherKey signs tokens as test-key, but is not the issuer's key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner := signer.NewStatic(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key: jose.JSONWebKey{
+			Key:       otherKey,
+			KeyID:     "test-key",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		},
+	}, nil)
+	unknownSigner := signer.NewStatic(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key: jose.JSONWebKey{
+			Key:       otherKey,
+			KeyID:     "unknown-key",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		},
+	}, nil)
+
+	cases := []struct {
+		name string
+		// token returns the token to authenticate with for the issuer.
+		token            func(issuer *testIssuer) string
+		unavailable      bool
+		authorizedGroups []string
+		requireACRs      []string
+		requireAMRs      []string
+		requireClaims    []string
+		wantErr          error
+		wantCode         pamCode
+	}{
+		{
+			name: "valid token",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				})
+			},
+			wantCode: pamSuccess,
+		},
+		{
+			name: "expired token",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(-10 * time.Minute).Unix()),
+				})
+			},
+			wantErr:  ErrTokenExpired,
+			wantCode: pamAuthErr,
+		},
+		{
+			name: "bad signature",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, otherSigner, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				})
+			},
+			wantErr:  ErrBadSignature,
+			wantCode: pamAuthErr,
+		},
+		{
+			name: "unknown signing key",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, unknownSigner, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				})
+			},
+			wantErr:  ErrBadSignature,
+			wantCode: pamAuthErr,
+		},
+		{
+			name: "user mismatch",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jane",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				})
+			},
+			wantErr:  ErrUserMismatch,
+			wantCode: pamUserUnknown,
+		},
+		{
+			name: "group denied",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+					Extra: map[string]interface{}{
+						"groups": []string{"group-b"},
+					},
+				})
+			},
+			authorizedGroups: []string{"group-a"},
+			wantErr:          ErrGroupDenied,
+			wantCode:         pamPermDenied,
+		},
+		{
+			name: "acr denied",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+					ACR:      "pwd",
+				})
+			},
+			requireACRs: []string{"mfa"},
+			wantErr:     ErrACRDenied,
+			wantCode:    pamPermDenied,
+		},
+		{
+			name: "amr denied",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+					AMR:      []string{"pwd"},
+				})
+			},
+			requireAMRs: []string{"mfa"},
+			wantErr:     ErrAMRDenied,
+			wantCode:    pamPermDenied,
+		},
+		{
+			name: "claim denied",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+					Extra: map[string]interface{}{
+						"hd": "gmail.com",
+					},
+				})
+			},
+			requireClaims: []string{"hd==example.com"},
+			wantErr:       ErrClaimDenied,
+			wantCode:      pamPermDenied,
+		},
+		{
+			name: "issuer unavailable",
+			token: func(issuer *testIssuer) string {
+				return mustJWT(t, issuer.signer, oidc.Claims{
+					Issuer:   issuer.srv.URL,
+					Subject:  "jdoe",
+					Audience: []string{"valid-aud"},
+					Expiry:   oidc.UnixTime(now.Add(10 * time.Minute).Unix()),
+				})
+			},
+			unavailable: true,
+			wantErr:     ErrDiscoveryFailed,
+			wantCode:    pamAuthInfoUnavail,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			issuer := newTestIssuer(t)
+			issuer.unavailable = tc.unavailable
+
+			// Mirror pam_sm_authenticate_go, which maps discovery and
+			// authentication failures alike
+			err := func() error {
+				auth, err := discoverAuthenticator(ctx, issuer.provider(), "valid-aud")
+				if err != nil {
+					return fmt.Errorf("failed to discover authenticator: %w", err)
+				}
+				auth.AuthorizedGroups = tc.authorizedGroups
+				auth.RequireACRs = tc.requireACRs
+				auth.RequireAMRs = tc.requireAMRs
+				auth.RequireClaims = tc.requireClaims
+
+				if _, err := auth.Authenticate(ctx, "jdoe", tc.token(issuer)); err != nil {
+					return fmt.Errorf("failed to authenticate: %w", err)
+				}
+				return nil
+			}()
+
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("want no err, got %v", err)
+			} else if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			}
+
+			if code := authenticateCode(err); code != tc.wantCode {
+				t.Errorf("want code %v, got %v (err %v)", tc.wantCode, code, err)
+			}
+		})
+	}
+}
+
+func TestIntrospectionAuthenticateCode(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+	issuer.clientSecret = "valid-secret"
+	issuer.introspection = map[string]map[string]interface{}{
+		"expired-token": {
+			"active": true,
+			"sub":    "jdoe",
+			"aud":    "valid-aud",
+			"exp":    time.Now().Add(-1 * time.Minute).Unix(),
+		},
+	}
+
+	auth, err := discoverIntrospectionAuthenticator(ctx, issuer.provider(), "valid-aud", "valid-aud", "valid-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = auth.Authenticate(ctx, "jdoe", "expired-token")
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("want err %v, got %v", ErrTokenExpired, err)
+	}
+	if code := authenticateCode(err); code != pamAuthErr {
+		t.Errorf("want code %v, got %v", pamAuthErr, code)
+	}
+
+	issuer.unavailable = true
+	_, err = auth.Authenticate(ctx, "jdoe", "expired-token")
+	if !errors.Is(err, ErrDiscoveryFailed) {
+		t.Errorf("want err %v, got %v", ErrDiscoveryFailed, err)
+	}
+	if code := authenticateCode(err); code != pamAuthInfoUnavail {
+		t.Errorf("want code %v, got %v", pamAuthInfoUnavail, code)
+	}
+}
+
+func TestPAMCode(t *testing.T) {
+	cases := []struct {
+		name            string
+		err             error
+		wantAuthCode    pamCode
+		wantAccountCode pamCode
+	}{
+		{
+			name:            "success",
+			wantAuthCode:    pamSuccess,
+			wantAccountCode: pamSuccess,
+		},
+		{
+			name:            "untrusted issuer",
+			err:             fmt.Errorf("failed to select issuer: %w", authErrorf(reasonUntrustedIssuer, "not trusted")),
+			wantAuthCode:    pamAuthErr,
+			wantAccountCode: pamPermDenied,
+		},
+		{
+			name:            "device flow failure while issuer unavailable",
+			err:             authErrorf(reasonDeviceFlow, "device flow: %w", authErrorf(reasonDiscovery, "unavailable")),
+			wantAuthCode:    pamAuthInfoUnavail,
+			wantAccountCode: pamPermDenied,
+		},
+		{
+			name:            "user mismatch",
+			err:             authErrorf(reasonUserMismatch, "expected user"),
+			wantAuthCode:    pamUserUnknown,
+			wantAccountCode: pamUserUnknown,
+		},
+		{
+			name:            "account expired",
+			err:             authErrorf(reasonAccountExpired, "%w", errAccountExpired),
+			wantAuthCode:    pamAuthErr,
+			wantAccountCode: pamAcctExpired,
+		},
+		{
+			name:            "account disabled",
+			err:             authErrorf(reasonAccountDisabled, "%w", errAccountDisabled),
+			wantAuthCode:    pamAuthErr,
+			wantAccountCode: pamPermDenied,
+		},
+		{
+			name:            "invalid user template",
+			err:             authErrorf(reasonUserTemplate, "parsing user template"),
+			wantAuthCode:    pamServiceErr,
+			wantAccountCode: pamPermDenied,
+		},
+		{
+			name:            "replay cache failure",
+			err:             authErrorf(reasonReplayCache, "permission denied"),
+			wantAuthCode:    pamSystemErr,
+			wantAccountCode: pamPermDenied,
+		},
+		{
+			name:            "untyped error",
+			err:             errors.New("unexpected"),
+			wantAuthCode:    pamAuthErr,
+			wantAccountCode: pamPermDenied,
+		},
+	}
+
+	for _, tc := range cases {
+		if code := authenticateCode(tc.err); code != tc.wantAuthCode {
+			t.Errorf("%s: want auth code %v, got %v", tc.name, tc.wantAuthCode, code)
+		}
+		if code := accountCode(tc.err); code != tc.wantAccountCode {
+			t.Errorf("%s: want account code %v, got %v", tc.name, tc.wantAccountCode, code)
+		}
+	}
+}
@@ -1,18 +1,26 @@
 module git.dev.pardot.com/pardot/pam_oidc
 
-go 1.17
+go 1.18
 
 require (
-	github.com/google/go-cmp v0.5.5
+	github.com/google/cel-go v0.17.8
+	github.com/google/go-cmp v0.5.9
 	github.com/pardot/oidc v0.0.0-20210414175742-5e4b86258770
 	golang.org/x/net v0.17.0
 	gopkg.in/square/go-jose.v2 v2.5.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/antlr/antlr4/runtime/Go/antlr/v4 v4.0.0-20230305170008-8188dc5388df // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/stoewer/go-strcase v1.2.0 // indirect
 	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/appengine v1.4.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20230525234035-dd9d682886f9 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
 )
@@ -0,0 +1,219 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pardot/oidc"
+)
+
+const (
+	// groupRegexpPrefix marks a group pattern as a regular expression.
+	groupRegexpPrefix = "re:"
+	// groupGlobPrefix marks a group pattern as a glob.
+	groupGlobPrefix = "glob:"
+)
+
+// groupPattern matches group names. A pattern is either a regular expression
+// prefixed with `re:`, which must match the whole name, a glob prefixed with
+// `glob:`, such as `glob:team-db-*`, or otherwise the name of a single group.
+// Group names such as `CORP\admins` may contain glob metacharacters, so are
+// only treated as patterns when marked.
+type groupPattern struct {
+	name string
+	glob string
+	re   *regexp.Regexp
+}
+
+// parseGroupPattern parses a single group pattern.
+func parseGroupPattern(s string) (groupPattern, error) {
+	switch {
+	case strings.HasPrefix(s, groupRegexpPrefix):
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(s, groupRegexpPrefix) + ")$")
+		if err != nil {
+			return groupPattern{}, fmt.Errorf("invalid group pattern %q: %v", s, err)
+		}
+
+		return groupPattern{re: re}, nil
+	case strings.HasPrefix(s, groupGlobPrefix):
+		glob := strings.TrimPrefix(s, groupGlobPrefix)
+		if _, err := path.Match(glob, ""); err != nil {
+			return groupPattern{}, fmt.Errorf("invalid group pattern %q: %v", s, err)
+		}
+
+		return groupPattern{glob: glob}, nil
+	default:
+		return groupPattern{name: s}, nil
+	}
+}
+
+// parseGroupPatterns parses each of the group patterns in list.
+func parseGroupPatterns(list []string) ([]groupPattern, error) {
+	patterns := make([]groupPattern, 0, len(list))
+	for _, s := range list {
+		p, err := parseGroupPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// Match reports whether group matches the pattern.
+func (p groupPattern) Match(group string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(group)
+	case p.glob != "":
+		// The pattern was checked when parsed, so cannot be malformed
+		ok, _ := path.Match(p.glob, group)
+		return ok
+	default:
+		return group == p.name
+	}
+}
+
+// matchesAnyGroup reports whether any of groups matches p.
+func (p groupPattern) matchesAnyGroup(groups []string) bool {
+	for _, group := range groups {
+		if p.Match(group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchingGroups returns the groups matching any of the patterns.
+func matchingGroups(patterns []groupPattern, groups []string) []string {
+	var matched []string
+	for _, group := range groups {
+		for _, p := range patterns {
+			if p.Match(group) {
+				matched = append(matched, group)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// groupRestriction is the group part of an option restricting the members of
+// the groups matching a pattern, of the form `<group>@<restriction>`.
+type groupRestriction struct {
+	group   string
+	pattern groupPattern
+}
+
+// parseGroupRestriction splits s into its group restriction and the rest of
+// s after the @. form describes the rest, for errors.
+func parseGroupRestriction(s string, form string) (groupRestriction, string, error) {
+	// Group names may contain @, but restrictions cannot
+	i := strings.LastIndex(s, "@")
+	if i <= 0 {
+		return groupRestriction{}, "", fmt.Errorf("expected <group>@%s", form)
+	}
+
+	pattern, err := parseGroupPattern(s[:i])
+	if err != nil {
+		return groupRestriction{}, "", err
+	}
+
+	return groupRestriction{group: s[:i], pattern: pattern}, s[i+1:], nil
+}
+
+// restrictedGroup is a group restricted by one or more group restrictions.
+type restrictedGroup struct {
+	group string
+	// indexes are the indexes of the restrictions of the group.
+	indexes []int
+}
+
+// restrictedGroups combines the n restrictions, returned by restriction, of
+// each group that one of groups matches, in the order the groups are first
+// restricted. Members must satisfy at least one restriction of each.
+func restrictedGroups(n int, restriction func(i int) groupRestriction, groups []string) []restrictedGroup {
+	var restricted []restrictedGroup
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		r := restriction(i)
+		if !r.pattern.matchesAnyGroup(groups) {
+			continue
+		}
+
+		j, ok := seen[r.group]
+		if !ok {
+			j = len(restricted)
+			seen[r.group] = j
+			restricted = append(restricted, restrictedGroup{group: r.group})
+		}
+		restricted[j].indexes = append(restricted[j].indexes, i)
+	}
+
+	return restricted
+}
+
+// claimGroups returns the groups in the claims at each of groupsClaimKeys, or
+// `groups` if empty, in the order they first appear. A claim may be a list, or
+// a string of groups separated by spaces or commas. ok is false if none of the
+// claims are present.
+func claimGroups(claims *oidc.Claims, groupsClaimKeys []string) (groups []string, ok bool) {
+	if len(groupsClaimKeys) == 0 {
+		groupsClaimKeys = []string{"groups"}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range groupsClaimKeys {
+		claimGroups, claimOK := parseGroupsClaim(findClaim(claims.Extra, key))
+		if !claimOK {
+			continue
+		}
+		ok = true
+
+		for _, group := range claimGroups {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	if ok && groups == nil {
+		groups = []string{}
+	}
+
+	return groups, ok
+}
+
+// parseGroupsClaim returns the groups in a groups claim, which is either a
+// list or a string of groups separated by spaces or commas. ok is false for
+// any other claim.
+func parseGroupsClaim(v interface{}) (groups []string, ok bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		groups = make([]string, 0, len(v))
+		for _, groupVal := range v {
+			if group, ok := groupVal.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+		return groups, true
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}), true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestGroupPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		group   string
+		want    bool
+	}{
+		{pattern: "engineering", group: "engineering", want: true},
+		{pattern: "engineering", group: "engineering-managers", want: false},
+		{pattern: "glob:team-db-*", group: "team-db-prod", want: true},
+		{pattern: "glob:team-db-*", group: "team-web-prod", want: false},
+		{pattern: "glob:team-?", group: "team-a", want: true},
+		{pattern: "glob:/eng/*", group: "/eng/db", want: true},
+		{pattern: "glob:/eng/*", group: "/eng/db/admins", want: false},
+		// Names without a prefix match exactly, even with metacharacters
+		{pattern: "team-db-*", group: "team-db-*", want: true},
+		{pattern: "team-db-*", group: "team-db-prod", want: false},
+		{pattern: `CORP\admins`, group: `CORP\admins`, want: true},
+		{pattern: `CORP\admins`, group: "CORPadmins", want: false},
+		{pattern: "[admins]", group: "[admins]", want: true},
+		{pattern: "[admins]", group: "a", want: false},
+		{pattern: "team-[db", group: "team-[db", want: true},
+		{pattern: "re:eng-(web|api)", group: "eng-api", want: true},
+		{pattern: "re:eng-(web|api)", group: "eng-api-admins", want: false},
+		{pattern: "re:eng-(web|api)", group: "my-eng-web", want: false},
+		{pattern: "re:.*-admins", group: "db-admins", want: true},
+	}
+
+	for _, tc := range cases {
+		p, err := parseGroupPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("parseGroupPattern(%q): %v", tc.pattern, err)
+		}
+
+		if got := p.Match(tc.group); got != tc.want {
+			t.Errorf("pattern %q matching %q: want %t, got %t", tc.pattern, tc.group, tc.want, got)
+		}
+	}
+}
+
+func TestRestrictedGroups(t *testing.T) {
+	list := []string{
+		"contractors@10.8.0.0/16",
+		"glob:team-*@10.9.0.0/16",
+		"ops@me@example.com@10.10.0.0/16",
+		"contractors@10.11.0.0/16",
+		"interns@10.12.0.0/16",
+	}
+	var restrictions []groupRestriction
+	for _, s := range list {
+		r, _, err := parseGroupRestriction(s, "<network>")
+		if err != nil {
+			t.Fatalf("parseGroupRestriction(%q): %v", s, err)
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	got := restrictedGroups(len(restrictions), func(i int) groupRestriction {
+		return restrictions[i]
+	}, []string{"team-db", "contractors", "ops@me@example.com"})
+	want := []restrictedGroup{
+		{group: "contractors", indexes: []int{0, 3}},
+		{group: "glob:team-*", indexes: []int{1}},
+		{group: "ops@me@example.com", indexes: []int{2}},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(restrictedGroup{})); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	for _, s := range []string{"10.8.0.0/16", "@10.8.0.0/16", "re:(@10.8.0.0/16"} {
+		if _, _, err := parseGroupRestriction(s, "<network>"); err == nil {
+			t.Errorf("parseGroupRestriction(%q): want error, got none", s)
+		}
+	}
+}
+
+func TestClaimGroups(t *testing.T) {
+	// Claims as issued by Keycloak and Azure AD, and by an issuer that
+	// namespaces its custom claims
+	claims := &oidc.Claims{
+		Extra: map[string]interface{}{
+			"groups": []interface{}{"engineering", "oncall"},
+			"realm_access": map[string]interface{}{
+				"roles": []interface{}{"offline_access", "admin"},
+			},
+			"resource_access": map[string]interface{}{
+				"my.client": map[string]interface{}{
+					"roles": []interface{}{"deploy", "admin"},
+				},
+			},
+			"scp":                        "openid groups.read  groups.write",
+			"teams":                      "db,web",
+			"https://example.com/groups": []interface{}{"namespaced"},
+			"count":                      3,
+		},
+	}
+
+	cases := []struct {
+		name   string
+		keys   []string
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "default",
+			want:   []string{"engineering", "oncall"},
+			wantOK: true,
+		},
+		{
+			name:   "dotted path",
+			keys:   []string{"realm_access.roles"},
+			want:   []string{"offline_access", "admin"},
+			wantOK: true,
+		},
+		{
+			name:   "quoted path",
+			keys:   []string{`resource_access["my.client"].roles`},
+			want:   []string{"deploy", "admin"},
+			wantOK: true,
+		},
+		{
+			name:   "claim name containing dots",
+			keys:   []string{"https://example.com/groups"},
+			want:   []string{"namespaced"},
+			wantOK: true,
+		},
+		{
+			name:   "space-separated string",
+			keys:   []string{"scp"},
+			want:   []string{"openid", "groups.read", "groups.write"},
+			wantOK: true,
+		},
+		{
+			name:   "comma-separated string",
+			keys:   []string{"teams"},
+			want:   []string{"db", "web"},
+			wantOK: true,
+		},
+		{
+			name:   "merged claims",
+			keys:   []string{"groups", "realm_access.roles", `resource_access["my.client"].roles`},
+			want:   []string{"engineering", "oncall", "offline_access", "admin", "deploy"},
+			wantOK: true,
+		},
+		{
+			name:   "merged with missing claim",
+			keys:   []string{"missing", "teams"},
+			want:   []string{"db", "web"},
+			wantOK: true,
+		},
+		{
+			name: "missing claim",
+			keys: []string{"realm_access.missing"},
+		},
+		{
+			name: "malformed claim",
+			keys: []string{"count"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := claimGroups(claims, tc.keys)
+			if ok != tc.wantOK {
+				t.Errorf("want ok %t, got %t", tc.wantOK, ok)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected groups (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthorizeGroups(t *testing.T) {
+	cases := []struct {
+		name             string
+		groups           []interface{}
+		authorizedGroups []string
+		requiredGroups   []string
+		deniedGroups     []string
+		wantErr          string
+		wantReason       reasonCode
+	}{
+		{
+			name:   "no requirements",
+			groups: []interface{}{"group-a"},
+		},
+		{
+			name:             "member of authorized domain group",
+			groups:           []interface{}{`CORP\admins`},
+			authorizedGroups: []string{`CORP\admins`},
+		},
+		{
+			name:             "not member of authorized domain group",
+			groups:           []interface{}{"CORPadmins"},
+			authorizedGroups: []string{`CORP\admins`},
+			wantErr:          `user is member of [CORPadmins], but one of [CORP\admins] is required`,
+			wantReason:       reasonGroupDenied,
+		},
+		{
+			name:             "member of authorized group with brackets",
+			groups:           []interface{}{"[prod] admins"},
+			authorizedGroups: []string{"[prod] admins"},
+		},
+		{
+			name:             "member of authorized glob",
+			groups:           []interface{}{"team-db-prod"},
+			authorizedGroups: []string{"glob:team-web-*", "glob:team-db-*"},
+		},
+		{
+			name:             "not member of authorized glob",
+			groups:           []interface{}{"team-api-prod"},
+			authorizedGroups: []string{"glob:team-web-*", "glob:team-db-*"},
+			wantErr:          "user is member of [team-api-prod], but one of [glob:team-web-* glob:team-db-*] is required",
+			wantReason:       reasonGroupDenied,
+		},
+		{
+			name:           "member of all required groups",
+			groups:         []interface{}{"engineering", "oncall", "team-db-prod"},
+			requiredGroups: []string{"engineering", "glob:team-db-*"},
+		},
+		{
+			name:           "not member of all required groups",
+			groups:         []interface{}{"engineering", "oncall"},
+			requiredGroups: []string{"engineering", "glob:team-db-*"},
+			wantErr:        `user is member of [engineering oncall], but all of [engineering glob:team-db-*] are required, including "glob:team-db-*"`,
+			wantReason:     reasonGroupDenied,
+		},
+		{
+			name:           "no groups with required groups",
+			requiredGroups: []string{"engineering"},
+			wantErr:        "user is not member of any groups, but all of [engineering] are required",
+			wantReason:     reasonGroupDenied,
+		},
+		{
+			name:           "required and not denied",
+			groups:         []interface{}{"engineering"},
+			requiredGroups: []string{"engineering"},
+			deniedGroups:   []string{"contractors"},
+		},
+		{
+			name:           "required but denied",
+			groups:         []interface{}{"engineering", "contractors"},
+			requiredGroups: []string{"engineering"},
+			deniedGroups:   []string{"contractors"},
+			wantErr:        "user is member of [contractors], which are denied by [contractors]",
+			wantReason:     reasonGroupDenied,
+		},
+		{
+			name:         "denied by regexp",
+			groups:       []interface{}{"vendor-acme", "vendor-globex", "engineering"},
+			deniedGroups: []string{"re:vendor-.*"},
+			wantErr:      "user is member of [vendor-acme vendor-globex], which are denied by [re:vendor-.*]",
+			wantReason:   reasonGroupDenied,
+		},
+		{
+			name:         "no groups with denied groups",
+			deniedGroups: []string{"contractors"},
+		},
+		{
+			name:           "invalid pattern",
+			groups:         []interface{}{"engineering"},
+			requiredGroups: []string{"re:("},
+			wantErr:        "required groups: invalid group pattern",
+			wantReason:     reasonConfig,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &oidc.Claims{Extra: map[string]interface{}{}}
+			if tc.groups != nil {
+				claims.Extra["groups"] = tc.groups
+			}
+
+			auth := &authenticator{}
+			auth.AuthorizedGroups = tc.authorizedGroups
+			auth.RequiredGroups = tc.requiredGroups
+			auth.DeniedGroups = tc.deniedGroups
+
+			err := auth.authorize(claims)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			}
+
+			if tc.wantReason == reasonGroupDenied && !errors.Is(err, ErrGroupDenied) {
+				t.Errorf("want errors.Is(err, ErrGroupDenied), got %v", err)
+			} else if err != nil && failureReason(err) != tc.wantReason {
+				t.Errorf("want reason %v, got %v", tc.wantReason, failureReason(err))
+			}
+		})
+	}
+}
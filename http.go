@@ -0,0 +1,255 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	// defaultConnectTimeout is the maximum time to connect to the issuer.
+	defaultConnectTimeout = 5 * time.Second
+	// defaultTLSTimeout is the maximum time for the TLS handshake with the
+	// issuer.
+	defaultTLSTimeout = 5 * time.Second
+	// defaultHTTPTimeout is the maximum time for each request to the issuer,
+	// including reading the response.
+	defaultHTTPTimeout = 10 * time.Second
+	// defaultHTTPRetries is the number of times a failed request for metadata
+	// or keys is retried.
+	defaultHTTPRetries = 2
+	// defaultAuthTimeout is the maximum time to verify a token.
+	defaultAuthTimeout = 30 * time.Second
+
+	// minRetryBackoff and maxRetryBackoff bound the backoff between retries.
+	minRetryBackoff = 250 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+// httpOptions configure the HTTP client used to connect to the issuer.
+type httpOptions struct {
+	// Proxy, if set, overrides the proxy from the environment.
+	Proxy string
+	// ConnectTimeout is the maximum time to connect. defaultConnectTimeout is
+	// used by default if not set.
+	ConnectTimeout time.Duration
+	// TLSTimeout is the maximum time for the TLS handshake. defaultTLSTimeout
+	// is used by default if not set.
+	TLSTimeout time.Duration
+	// Timeout is the maximum time for each request. defaultHTTPTimeout is used
+	// by default if not set.
+	Timeout time.Duration
+	// CAFile, if set, is a file of PEM certificates trusted instead of the
+	// system roots.
+	CAFile string
+	// TLSMinVersion, if set, is the minimum TLS version.
+	TLSMinVersion uint16
+	// TLSPins, if set, are the base64-encoded SHA-256 hashes of public keys, one
+	// of which must be in the issuer's verified certificate chain.
+	TLSPins []string
+	// ClientCertFile and ClientKeyFile, if set, are the PEM certificate and key
+	// presented to the issuer for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// tlsVersions are the TLS versions that may be required.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPClient returns the HTTP client used to connect to the issuer.
+func newHTTPClient(opts httpOptions) (*http.Client, error) {
+	connectTimeout := opts.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	tlsTimeout := opts.TLSTimeout
+	if tlsTimeout == 0 {
+		tlsTimeout = defaultTLSTimeout
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultHTTPTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = tlsTimeout
+
+	tlsConfig := &tls.Config{
+		MinVersion: opts.TLSMinVersion,
+	}
+	if opts.CAFile != "" {
+		roots, err := loadCAFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := newClientCertificate(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cert.GetClientCertificate
+	}
+	if len(opts.TLSPins) > 0 {
+		tlsConfig.VerifyConnection = verifyPins(opts.TLSPins)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.Proxy != "" {
+		// Use no_proxy from environment, if present, but override proxy URL
+		cfg := httpproxy.FromEnvironment()
+		cfg.HTTPProxy = opts.Proxy
+		cfg.HTTPSProxy = opts.Proxy
+
+		proxyFunc := cfg.ProxyFunc()
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyFunc(r.URL)
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// loadCAFile loads the PEM certificates in path as a pool of roots. Because
+// the roots decide which issuers are trusted, the file must be owned by the
+// current user or root, and must not be writable by others.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	} else if err := checkOwnership(path, fi); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("reading CA file: no certificates found in %s", path)
+	}
+
+	return roots, nil
+}
+
+// parseTLSPin parses the base64-encoded SHA-256 hash of a public key, as
+// printed by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func parseTLSPin(pin string) error {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid pin %q: expected base64-encoded SHA-256 hash", pin)
+	}
+
+	return nil
+}
+
+// tlsPin returns the pin of the public key of cert.
+func tlsPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// pinError is returned when no public key of the issuer's certificate chain is
+// pinned.
+type pinError struct {
+	got  []string
+	want []string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("certificate pin mismatch: chain has %s, but one of %s is required", strings.Join(e.got, ","), strings.Join(e.want, ","))
+}
+
+// verifyPins returns a function that checks that the public key of at least
+// one certificate in the verified chain is pinned. It runs after the chain is
+// verified, so pins restrict the trusted certificates, rather than replace
+// verification.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var got []string
+		seen := make(map[string]bool)
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				pin := tlsPin(cert)
+				if containsString(pins, pin) {
+					return nil
+				}
+				if !seen[pin] {
+					seen[pin] = true
+					got = append(got, pin)
+				}
+			}
+		}
+
+		return &pinError{got: got, want: pins}
+	}
+}
+
+// retryBackoff returns how long to wait before retry attempt n, counting from
+// zero: an exponential backoff with full jitter, so that many hosts retrying
+// an issuer that is recovering do not do so in lockstep. The jitter is drawn
+// from crypto/rand, as the default math/rand source is not seeded before Go
+// 1.20, so would give every host the same delays.
+func retryBackoff(n int) time.Duration {
+	backoff := maxRetryBackoff
+	if n < 4 {
+		backoff = minRetryBackoff << n
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(backoff)))
+	if err != nil {
+		return backoff
+	}
+
+	return time.Duration(jitter.Int64()) + 1
+}
+
+// isRetryableStatus reports whether a request that returned status may
+// succeed if retried.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProviderRetries(t *testing.T) {
+	cases := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantRequests int
+		wantErr      string
+	}{
+		{
+			name:         "no failures",
+			retries:      2,
+			wantRequests: 1,
+		},
+		{
+			name:         "recovers within retries",
+			failures:     2,
+			retries:      2,
+			wantRequests: 3,
+		},
+		{
+			name:         "fails after retries",
+			failures:     3,
+			retries:      2,
+			wantRequests: 3,
+			wantErr:      "unexpected status 503",
+		},
+		{
+			name:         "no retries",
+			failures:     1,
+			retries:      0,
+			wantRequests: 1,
+			wantErr:      "unexpected status 503",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newTestIssuer(t)
+			issuer.failures = tc.failures
+
+			p := issuer.provider()
+			p.retries = tc.retries
+
+			_, err := p.Metadata(context.Background())
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if got := issuer.requests[wellKnownConfiguration]; got != tc.wantRequests {
+				t.Errorf("want %d requests, got %d", tc.wantRequests, got)
+			}
+		})
+	}
+}
+
+func TestProviderTimeouts(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+	}{
+		{
+			name:    "request timeout",
+			timeout: 100 * time.Millisecond,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+		{
+			name:    "authentication deadline",
+			timeout: time.Minute,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 300*time.Millisecond)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newTestIssuer(t)
+			issuer.delay = 5 * time.Second
+
+			hc, err := newHTTPClient(httpOptions{Timeout: tc.timeout})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newProvider(hc, issuer.srv.URL, nil)
+			p.retries = 1
+
+			ctx, cancel := tc.ctx()
+			defer cancel()
+
+			start := time.Now()
+			_, err = p.Metadata(ctx)
+			if err == nil {
+				t.Fatal("want err, got none")
+			} else if !errors.Is(err, ErrDiscoveryFailed) {
+				t.Errorf("want errors.Is(err, ErrDiscoveryFailed), got %v", err)
+			}
+
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("want the slow issuer to be abandoned, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for n := 0; n < 10; n++ {
+		max := minRetryBackoff << n
+		if max > maxRetryBackoff || n >= 4 {
+			max = maxRetryBackoff
+		}
+
+		for i := 0; i < 100; i++ {
+			if d := retryBackoff(n); d <= 0 || d > max {
+				t.Fatalf("retryBackoff(%d) = %v, want (0, %v]", n, d, max)
+			}
+		}
+	}
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	requests := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": "https://" + r.Host})
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pin := tlsPin(srv.Certificate())
+	otherPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	cases := []struct {
+		name         string
+		opts         httpOptions
+		wantErr      string
+		wantRequests int
+	}{
+		{
+			name:    "system roots",
+			opts:    httpOptions{},
+			wantErr: "certificate",
+		},
+		{
+			name:         "CA file",
+			opts:         httpOptions{CAFile: caFile},
+			wantRequests: 1,
+		},
+		{
+			name:         "pinned key",
+			opts:         httpOptions{CAFile: caFile, TLSPins: []string{otherPin, pin}},
+			wantRequests: 1,
+		},
+		{
+			name:    "pin mismatch",
+			opts:    httpOptions{CAFile: caFile, TLSPins: []string{otherPin}},
+			wantErr: "certificate pin mismatch: chain has " + pin + ", but one of " + otherPin + " is required",
+		},
+		{
+			name:    "minimum TLS version",
+			opts:    httpOptions{CAFile: caFile, TLSMinVersion: tls.VersionTLS13},
+			wantErr: "protocol version",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			requests = 0
+
+			hc, err := newHTTPClient(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newProvider(hc, srv.URL, nil)
+			p.retries = 0
+
+			_, err = p.Metadata(context.Background())
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if requests != tc.wantRequests {
+				t.Errorf("want %d requests, got %d", tc.wantRequests, requests)
+			}
+		})
+	}
+}
+
+func TestPinsNotRetried(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	// ConnState is called by the server, so must be set before it starts
+	var handshakes int32
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&handshakes, 1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	hc, err := newHTTPClient(httpOptions{TLSPins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.Transport.(*http.Transport).TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	p := newProvider(hc, srv.URL, nil)
+	if _, err := p.Metadata(context.Background()); err == nil || !strings.Contains(err.Error(), "certificate pin mismatch") {
+		t.Fatalf("want pin mismatch, got %v", err)
+	}
+	if n := atomic.LoadInt32(&handshakes); n != 1 {
+		t.Errorf("want 1 connection, got %d", n)
+	}
+}
+
+func TestNewHTTPClientCAFile(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writable := filepath.Join(dir, "writable.pem")
+	if err := os.WriteFile(writable, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chmod(writable, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		caFile  string
+		wantErr string
+	}{
+		{
+			name:    "missing",
+			caFile:  filepath.Join(dir, "missing.pem"),
+			wantErr: "reading CA file: open",
+		},
+		{
+			name:    "no certificates",
+			caFile:  notPEM,
+			wantErr: "reading CA file: no certificates found in " + notPEM,
+		},
+		{
+			name:    "writable by group",
+			caFile:  writable,
+			wantErr: writable + " must not be writable by group or others",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newHTTPClient(httpOptions{CAFile: tc.caFile})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// introspector validates opaque tokens using OAuth 2.0 Token Introspection
+// (RFC 7662).
+type introspector struct {
+	// ClientID is the OAuth 2.0 client ID used to authenticate to the
+	// introspection endpoint.
+	ClientID string
+
+	// ClientSecret is the OAuth 2.0 client secret used to authenticate to the
+	// introspection endpoint.
+	ClientSecret string
+
+	httpClient *http.Client
+	issuer     string
+	endpoint   string
+
+	// clock returns the current time. time.Now is used by default.
+	clock func() time.Time
+}
+
+func discoverIntrospector(ctx context.Context, p *provider) (*introspector, error) {
+	md, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, authErrorf(reasonDiscovery, "discovering introspection endpoint: %v", err)
+	}
+
+	if md.IntrospectionEndpoint == "" {
+		return nil, authErrorf(reasonDiscovery, "issuer does not support token introspection")
+	}
+
+	return &introspector{
+		httpClient: p.httpClient,
+		issuer:     p.issuer,
+		endpoint:   md.IntrospectionEndpoint,
+	}, nil
+}
+
+// Introspect validates token with the introspection endpoint, returning the
+// introspection response as claims. The token must be active, unexpired and
+// issued for aud.
+func (i *introspector) Introspect(ctx context.Context, aud string, token string) (*oidc.Claims, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	resp, err := postForm(ctx, i.httpClient, i.endpoint, i.ClientID, i.ClientSecret, form)
+	if err != nil {
+		return nil, authErrorf(reasonDiscovery, "requesting introspection: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, authErrorf(reasonDiscovery, "requesting introspection: %v", tokenError(resp))
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, authErrorf(reasonConfig, "requesting introspection: %v", tokenError(resp))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, authErrorf(reasonDiscovery, "reading introspection response: %v", err)
+	}
+
+	var active struct {
+		Active bool `json:"active"`
+	}
+	if err := json.Unmarshal(body, &active); err != nil {
+		return nil, authErrorf(reasonDiscovery, "decoding introspection response: %v", err)
+	} else if !active.Active {
+		return nil, authErrorf(reasonInvalidToken, "token is not active")
+	}
+
+	// The introspection response uses the same names as JWT claims for the
+	// members it has in common, so it decodes directly into claims.
+	claims := new(oidc.Claims)
+	if err := json.Unmarshal(body, claims); err != nil {
+		return nil, authErrorf(reasonDiscovery, "decoding introspection response: %v", err)
+	}
+
+	clock := time.Now
+	if i.clock != nil {
+		clock = i.clock
+	}
+	now := clock()
+
+	if claims.Issuer != "" && claims.Issuer != i.issuer {
+		return nil, authErrorf(reasonInvalidToken, "token issued by %q, but %q is expected", claims.Issuer, i.issuer)
+	}
+	if !claims.Audience.Contains(aud) {
+		return nil, authErrorf(reasonInvalidToken, "token audience is %v, but %q is expected", []string(claims.Audience), aud)
+	}
+	if claims.Expiry != 0 && !now.Before(claims.Expiry.Time()) {
+		return nil, authErrorf(reasonTokenExpired, "token is expired")
+	}
+	if claims.NotBefore != 0 && now.Before(claims.NotBefore.Time()) {
+		return nil, authErrorf(reasonInvalidToken, "token is not valid yet")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntrospectionAuthenticate(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name             string
+		user             string
+		introspection    map[string]interface{}
+		userTemplates    []string
+		authorizedGroups []string
+		requireACRs      []string
+		wantErr          string
+	}{
+		{
+			name: "active token",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active": true,
+				"sub":    "jdoe",
+				"aud":    "valid-aud",
+				"exp":    now.Add(10 * time.Minute).Unix(),
+			},
+		},
+		{
+			name: "active token, user template, groups and acr",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active":   true,
+				"sub":      "00u1abcd",
+				"username": "jdoe@example.com",
+				"aud":      []string{"other-aud", "valid-aud"},
+				"exp":      now.Add(10 * time.Minute).Unix(),
+				"groups":   []string{"group-a"},
+				"acr":      "mfa",
+			},
+			userTemplates:    []string{`{{.Extra.username | trimSuffix "@example.com"}}`},
+			authorizedGroups: []string{"group-a"},
+			requireACRs:      []string{"mfa"},
+		},
+		{
+			name: "active token, not member of authorized group",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active": true,
+				"sub":    "jdoe",
+				"aud":    "valid-aud",
+				"groups": []string{"group-b"},
+			},
+			authorizedGroups: []string{"group-a"},
+			wantErr:          "user is member of [group-b], but one of [group-a] is required",
+		},
+		{
+			name:    "inactive token",
+			user:    "jdoe",
+			wantErr: "token is not active",
+		},
+		{
+			name: "expired token",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active": true,
+				"sub":    "jdoe",
+				"aud":    "valid-aud",
+				"exp":    now.Add(-1 * time.Minute).Unix(),
+			},
+			wantErr: "token is expired",
+		},
+		{
+			name: "incorrect aud",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active": true,
+				"sub":    "jdoe",
+				"aud":    "invalid-aud",
+			},
+			wantErr: `token audience is [invalid-aud], but "valid-aud" is expected`,
+		},
+		{
+			name: "incorrect iss",
+			user: "jdoe",
+			introspection: map[string]interface{}{
+				"active": true,
+				"iss":    "https://invalid.example.com",
+				"sub":    "jdoe",
+				"aud":    "valid-aud",
+			},
+			wantErr: `token issued by "https://invalid.example.com"`,
+		},
+		{
+			name: "invalid user",
+			user: "invalid",
+			introspection: map[string]interface{}{
+				"active": true,
+				"sub":    "jdoe",
+				"aud":    "valid-aud",
+			},
+			wantErr: `expected user "jdoe"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			issuer := newTestIssuer(t)
+			issuer.clientSecret = "valid-secret"
+			if tc.introspection != nil {
+				issuer.introspection = map[string]map[string]interface{}{
+					"opaque-token": tc.introspection,
+				}
+			}
+
+			auth, err := discoverIntrospectionAuthenticator(ctx, issuer.provider(), "valid-aud", "valid-aud", "valid-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth.UserTemplates = tc.userTemplates
+			auth.AuthorizedGroups = tc.authorizedGroups
+			auth.RequireACRs = tc.requireACRs
+
+			_, err = auth.Authenticate(ctx, tc.user, "opaque-token")
+			if err != nil && tc.wantErr == "" {
+				t.Errorf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Errorf("want err %v, got none", tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntrospectionInvalidClient(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+	issuer.clientSecret = "valid-secret"
+
+	auth, err := discoverIntrospectionAuthenticator(ctx, issuer.provider(), "valid-aud", "valid-aud", "invalid-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = auth.Authenticate(ctx, "jdoe", "opaque-token")
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("want invalid_client err, got %v", err)
+	}
+}
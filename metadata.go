@@ -0,0 +1,236 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const wellKnownConfiguration = "/.well-known/openid-configuration"
+
+// providerMetadata is the subset of the OpenID Provider Metadata used by
+// pam_oidc, including endpoints that discovery.ProviderMetadata does not
+// expose.
+type providerMetadata struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint"`
+}
+
+var _ oidc.KeySource = (*provider)(nil)
+
+// provider fetches the metadata and signing keys of an issuer. Responses are
+// kept in memory, and, if a cache is set, persisted so they can be used by
+// other processes and while the issuer is briefly unreachable.
+type provider struct {
+	issuer     string
+	httpClient *http.Client
+	cache      *fileCache
+	// retries is the number of times a failed request is retried.
+	retries int
+
+	// clock returns the current time. time.Now is used by default.
+	clock func() time.Time
+
+	mu   sync.Mutex
+	md   *providerMetadata
+	jwks *jose.JSONWebKeySet
+}
+
+func newProvider(hc *http.Client, issuer string, cache *fileCache) *provider {
+	return &provider{
+		issuer:     issuer,
+		httpClient: hc,
+		cache:      cache,
+		retries:    defaultHTTPRetries,
+	}
+}
+
+// Metadata returns the OpenID Provider Metadata for the issuer.
+func (p *provider) Metadata(ctx context.Context) (*providerMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.metadata(ctx)
+}
+
+func (p *provider) metadata(ctx context.Context) (*providerMetadata, error) {
+	if p.md != nil {
+		return p.md, nil
+	}
+
+	md := new(providerMetadata)
+	if err := p.get(ctx, strings.TrimSuffix(p.issuer, "/")+wellKnownConfiguration, false, md); err != nil {
+		return nil, authErrorf(reasonDiscovery, "fetching provider metadata: %v", err)
+	}
+	p.md = md
+
+	return md, nil
+}
+
+// GetKey returns the signing key with the given kid. If the key is not found
+// in the known keys, which may have been cached, the keys are fetched again in
+// case they were rotated.
+func (p *provider) GetKey(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	md, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	} else if md.JWKSURI == "" {
+		return nil, authErrorf(reasonDiscovery, "metadata has no JWKS endpoint, cannot fetch keys")
+	}
+
+	if p.jwks == nil {
+		jwks := new(jose.JSONWebKeySet)
+		if err := p.get(ctx, md.JWKSURI, false, jwks); err != nil {
+			return nil, authErrorf(reasonDiscovery, "fetching keys: %v", err)
+		}
+		p.jwks = jwks
+	}
+
+	if key := findKey(p.jwks, kid); key != nil {
+		return key, nil
+	}
+
+	jwks := new(jose.JSONWebKeySet)
+	if err := p.get(ctx, md.JWKSURI, true, jwks); err != nil {
+		return nil, authErrorf(reasonDiscovery, "fetching keys: %v", err)
+	}
+	p.jwks = jwks
+
+	if key := findKey(p.jwks, kid); key != nil {
+		return key, nil
+	}
+
+	// The token is signed by a key the issuer does not have
+	return nil, authErrorf(reasonBadSignature, "key %s not found", kid)
+}
+
+// get fetches url, decoding the JSON response into v. Unless refresh is set, a
+// fresh cached response is used instead of fetching. A stale cached response
+// is used if fetching fails, without retrying. A cached response that cannot
+// be read or trusted is ignored, and replaced once fetched.
+func (p *provider) get(ctx context.Context, url string, refresh bool, v interface{}) error {
+	clock := time.Now
+	if p.clock != nil {
+		clock = p.clock
+	}
+	now := clock()
+
+	var cached *cacheEntry
+	if p.cache != nil {
+		if entry, err := p.cache.Get(url); err == nil && entry != nil {
+			cached = entry
+		}
+
+		if cached != nil && !refresh && now.Before(cached.Expires) {
+			if err := json.Unmarshal(cached.Data, v); err == nil {
+				return nil
+			}
+			cached = nil
+		}
+	}
+
+	stale := cached != nil && now.Before(cached.Expires.Add(maxCacheStale))
+
+	retries := p.retries
+	if stale {
+		retries = 0
+	}
+
+	data, header, err := p.fetch(ctx, url, retries)
+	if err != nil {
+		if stale && json.Unmarshal(cached.Data, v) == nil {
+			return nil
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decoding %s: %v", url, err)
+	}
+
+	if p.cache != nil {
+		if expires, ok := cacheExpiry(header, now); ok {
+			// Failing to update the cache must not fail authentication, as the
+			// response is still valid.
+			_ = p.cache.Put(url, &cacheEntry{Data: data, Expires: expires})
+		}
+	}
+
+	return nil
+}
+
+// fetch fetches url, retrying up to retries times with backoff if the issuer
+// cannot be reached or fails with a server error, until ctx is done.
+func (p *provider) fetch(ctx context.Context, url string, retries int) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		data, header, retry, err := p.fetchOnce(ctx, url)
+		if err == nil {
+			return data, header, nil
+		} else if !retry || attempt >= retries {
+			return nil, nil, err
+		}
+
+		if sleepContext(ctx, retryBackoff(attempt)) != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// fetchOnce fetches url, reporting whether the request may succeed if retried
+// if it fails.
+func (p *provider) fetchOnce(ctx context.Context, url string) (data []byte, header http.Header, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		// A pinned certificate will not change if retried
+		var pe *pinError
+		return nil, nil, ctx.Err() == nil && !errors.As(err, &pe), fmt.Errorf("fetching %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, isRetryableStatus(resp.StatusCode), fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, ctx.Err() == nil, fmt.Errorf("fetching %s: %v", url, err)
+	}
+
+	return data, resp.Header, false, nil
+}
+
+func findKey(jwks *jose.JSONWebKeySet, kid string) *jose.JSONWebKey {
+	for _, k := range jwks.Keys {
+		if k.KeyID == kid {
+			k := k
+			return &k
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseNetwork parses a network in CIDR notation, such as `10.0.0.0/8`, or a
+// single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseNetworks parses each of the networks in list.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		ipnet, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipnet)
+	}
+
+	return networks, nil
+}
+
+// groupNetwork restricts members of the groups matching a pattern to a
+// network, of the form `<group>@<network>`, such as
+// `contractors@10.8.0.0/16`.
+type groupNetwork struct {
+	groupRestriction
+	network *net.IPNet
+}
+
+// parseGroupNetwork parses a single group network.
+func parseGroupNetwork(s string) (groupNetwork, error) {
+	r, network, err := parseGroupRestriction(s, "<network>")
+	if err != nil {
+		return groupNetwork{}, fmt.Errorf("invalid group network %q: %v", s, err)
+	}
+	ipnet, err := parseNetwork(network)
+	if err != nil {
+		return groupNetwork{}, fmt.Errorf("invalid group network %q: %v", s, err)
+	}
+
+	return groupNetwork{groupRestriction: r, network: ipnet}, nil
+}
+
+// parseGroupNetworks parses each of the group networks in list.
+func parseGroupNetworks(list []string) ([]groupNetwork, error) {
+	networks := make([]groupNetwork, 0, len(list))
+	for _, s := range list {
+		gn, err := parseGroupNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, gn)
+	}
+
+	return networks, nil
+}
+
+// parseRemoteHost parses the PAM remote host as an IP address. Host names are
+// not resolved, as the remote host can control its reverse DNS.
+func parseRemoteHost(rhost string) net.IP {
+	// Strip the zone of IPv6 link-local addresses, e.g. fe80::1%eth0
+	if i := strings.IndexByte(rhost, '%'); i >= 0 {
+		rhost = rhost[:i]
+	}
+
+	return net.ParseIP(strings.Trim(rhost, "[]"))
+}
+
+// inNetworks reports whether ip is in any of networks.
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, ipnet := range networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
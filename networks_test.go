@@ -0,0 +1,208 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pardot/oidc"
+)
+
+func TestParseNetwork(t *testing.T) {
+	cases := []struct {
+		network string
+		want    string
+		wantErr string
+	}{
+		{network: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{network: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{network: "192.0.2.1", want: "192.0.2.1/32"},
+		{network: "2001:db8::/32", want: "2001:db8::/32"},
+		{network: "2001:db8::1", want: "2001:db8::1/128"},
+		{network: "10.0.0.0/33", wantErr: `invalid network "10.0.0.0/33"`},
+		{network: "bastion.example.com", wantErr: `invalid network "bastion.example.com"`},
+	}
+
+	for _, tc := range cases {
+		got, err := parseNetwork(tc.network)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%q: want no err, got %v", tc.network, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: want err %v, got %v", tc.network, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%q: want err %v, got none", tc.network, tc.wantErr)
+		} else if err == nil && got.String() != tc.want {
+			t.Errorf("%q: want %v, got %v", tc.network, tc.want, got)
+		}
+	}
+}
+
+func TestAuthorizeNetworks(t *testing.T) {
+	cases := []struct {
+		name            string
+		rhost           string
+		groups          []interface{}
+		allowedNetworks []string
+		deniedNetworks  []string
+		groupNetworks   []string
+		wantErr         string
+	}{
+		{
+			name:  "no restrictions",
+			rhost: "198.51.100.7",
+		},
+		{
+			name:            "in allowed network",
+			rhost:           "10.1.2.3",
+			allowedNetworks: []string{"192.0.2.0/24", "10.0.0.0/8"},
+		},
+		{
+			name:            "not in allowed network",
+			rhost:           "198.51.100.7",
+			allowedNetworks: []string{"192.0.2.0/24", "10.0.0.0/8"},
+			wantErr:         "remote host 198.51.100.7 is not in allowed networks [192.0.2.0/24 10.0.0.0/8]",
+		},
+		{
+			name:            "allowed single address",
+			rhost:           "192.0.2.1",
+			allowedNetworks: []string{"192.0.2.1"},
+		},
+		{
+			name:            "ipv6 in allowed network",
+			rhost:           "2001:db8::7",
+			allowedNetworks: []string{"2001:db8::/32"},
+		},
+		{
+			name:            "ipv4-mapped ipv6 in allowed network",
+			rhost:           "::ffff:10.1.2.3",
+			allowedNetworks: []string{"10.0.0.0/8"},
+		},
+		{
+			name:            "link-local with zone in allowed network",
+			rhost:           "fe80::1%eth0",
+			allowedNetworks: []string{"fe80::/10"},
+		},
+		{
+			name:            "no remote host with allowed networks",
+			allowedNetworks: []string{"10.0.0.0/8"},
+			wantErr:         "remote host is not set, but network restrictions apply",
+		},
+		{
+			name:            "host name with allowed networks",
+			rhost:           "bastion.example.com",
+			allowedNetworks: []string{"10.0.0.0/8"},
+			wantErr:         `remote host "bastion.example.com" is not an IP address`,
+		},
+		{
+			name:           "in denied network",
+			rhost:          "10.66.0.1",
+			deniedNetworks: []string{"10.66.0.0/16"},
+			wantErr:        "remote host 10.66.0.1 is in denied networks [10.66.0.0/16]",
+		},
+		{
+			name:            "allowed but denied",
+			rhost:           "10.66.0.1",
+			allowedNetworks: []string{"10.0.0.0/8"},
+			deniedNetworks:  []string{"10.66.0.0/16"},
+			wantErr:         "remote host 10.66.0.1 is in denied networks [10.66.0.0/16]",
+		},
+		{
+			name:           "not in denied network",
+			rhost:          "10.1.2.3",
+			deniedNetworks: []string{"10.66.0.0/16"},
+		},
+		{
+			name:           "no remote host with denied networks",
+			deniedNetworks: []string{"10.66.0.0/16"},
+		},
+		{
+			name:           "host name with denied networks",
+			rhost:          "bastion.example.com",
+			deniedNetworks: []string{"10.66.0.0/16"},
+			wantErr:        `remote host "bastion.example.com" is not an IP address`,
+		},
+		{
+			name:          "restricted group member in group network",
+			rhost:         "10.8.1.1",
+			groups:        []interface{}{"engineering", "contractors"},
+			groupNetworks: []string{"contractors@10.8.0.0/16"},
+		},
+		{
+			name:          "restricted group member outside group network",
+			rhost:         "198.51.100.7",
+			groups:        []interface{}{"engineering", "contractors"},
+			groupNetworks: []string{"contractors@10.8.0.0/16"},
+			wantErr:       `remote host 198.51.100.7 is not in networks [10.8.0.0/16] of group "contractors"`,
+		},
+		{
+			name:          "restricted group member in second group network",
+			rhost:         "10.9.1.1",
+			groups:        []interface{}{"contractors"},
+			groupNetworks: []string{"contractors@10.8.0.0/16", "contractors@10.9.0.0/16"},
+		},
+		{
+			name:          "restricted group pattern",
+			rhost:         "198.51.100.7",
+			groups:        []interface{}{"vendor-acme"},
+			groupNetworks: []string{"glob:vendor-*@10.8.0.0/16"},
+			wantErr:       `not in networks [10.8.0.0/16] of group "glob:vendor-*"`,
+		},
+		{
+			name:          "unrestricted user outside group network",
+			rhost:         "198.51.100.7",
+			groups:        []interface{}{"engineering"},
+			groupNetworks: []string{"contractors@10.8.0.0/16"},
+		},
+		{
+			name:          "unrestricted user without remote host",
+			groups:        []interface{}{"engineering"},
+			groupNetworks: []string{"contractors@10.8.0.0/16"},
+		},
+		{
+			name:          "restricted group member without remote host",
+			groups:        []interface{}{"contractors"},
+			groupNetworks: []string{"contractors@10.8.0.0/16"},
+			wantErr:       "remote host is not set",
+		},
+		{
+			name:            "invalid network",
+			rhost:           "10.1.2.3",
+			allowedNetworks: []string{"10.0.0.0/33"},
+			wantErr:         `allowed networks: invalid network "10.0.0.0/33"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &oidc.Claims{Extra: map[string]interface{}{}}
+			if tc.groups != nil {
+				claims.Extra["groups"] = tc.groups
+			}
+
+			auth := &authenticator{}
+			auth.AllowedNetworks = tc.allowedNetworks
+			auth.DeniedNetworks = tc.deniedNetworks
+			auth.GroupNetworks = tc.groupNetworks
+			auth.Request = policyRequest{Service: "sshd", User: "jdoe", RHost: tc.rhost}
+
+			err := auth.authorize(claims)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if err != nil && failureReason(err) != reasonConfig && !errors.Is(err, ErrNetworkDenied) {
+				t.Errorf("want errors.Is(err, ErrNetworkDenied), got %v", err)
+			}
+		})
+	}
+}
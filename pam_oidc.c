@@ -5,6 +5,9 @@
 
 #include <security/pam_appl.h>
 
+#include <security/pam_modules.h>
+#include <stdlib.h>
+
 #ifdef __linux__
 #include <security/pam_ext.h>
 #endif
@@ -25,6 +28,30 @@ int pam_sm_setcred(pam_handle_t *pamh, int flags, int argc, char **argv) {
   return pam_sm_setcred_go(pamh, flags, argc, (char**)argv);
 }
 
+// pam_sm_open_session lightly wraps pam_sm_open_session_go because cgo cannot
+// natively create a method with 'const char**' as an argument.
+int pam_sm_open_session_go(pam_handle_t *pamh, int flags, int argc, char **argv);
+int pam_sm_open_session(pam_handle_t *pamh, int flags, int argc, const char **argv) {
+  // pam_sm_open_session_go does not modify argv, only copies them to Go strings.
+  return pam_sm_open_session_go(pamh, flags, argc, (char**)argv);
+}
+
+// pam_sm_close_session lightly wraps pam_sm_close_session_go because cgo
+// cannot natively create a method with 'const char**' as an argument.
+int pam_sm_close_session_go(pam_handle_t *pamh, int flags, int argc, char **argv);
+int pam_sm_close_session(pam_handle_t *pamh, int flags, int argc, const char **argv) {
+  // pam_sm_close_session_go does not modify argv, only copies them to Go strings.
+  return pam_sm_close_session_go(pamh, flags, argc, (char**)argv);
+}
+
+// pam_sm_acct_mgmt lightly wraps pam_sm_acct_mgmt_go because cgo cannot
+// natively create a method with 'const char**' as an argument.
+int pam_sm_acct_mgmt_go(pam_handle_t *pamh, int flags, int argc, char **argv);
+int pam_sm_acct_mgmt(pam_handle_t *pamh, int flags, int argc, const char **argv) {
+  // pam_sm_acct_mgmt_go does not modify argv, only copies them to Go strings.
+  return pam_sm_acct_mgmt_go(pamh, flags, argc, (char**)argv);
+}
+
 // argv_i returns argv[i].
 char* argv_i(char **argv, int i) {
   return argv[i];
@@ -37,3 +64,43 @@ void pam_syslog_str(pam_handle_t *pamh, int priority, const char *str) {
   pam_syslog(pamh, priority, "%s", str);
 #endif
 }
+
+// pam_info_str shows str to the user with pam_info. Calling variadic functions
+// directly is not supported with cgo.
+int pam_info_str(pam_handle_t *pamh, const char *str) {
+#ifdef __linux__
+  return pam_info(pamh, "%s", str);
+#else
+  return PAM_CONV_ERR;
+#endif
+}
+
+// pam_get_item_str gets a string PAM item. str is set to NULL if the item is
+// not set.
+int pam_get_item_str(pam_handle_t *pamh, int item, const char **str) {
+  const void *data = NULL;
+  int errnum = pam_get_item(pamh, item, &data);
+  *str = (const char*)data;
+  return errnum;
+}
+
+// cleanup_free frees module data set by pam_set_data_str.
+static void cleanup_free(pam_handle_t *pamh, void *data, int error_status) {
+  free(data);
+}
+
+// pam_set_data_str stores str, which must be allocated with malloc, as module
+// data. PAM takes ownership of str and frees it when the handle is ended.
+int pam_set_data_str(pam_handle_t *pamh, const char *name, char *str) {
+  return pam_set_data(pamh, name, str, cleanup_free);
+}
+
+// pam_get_data_str returns module data stored by pam_set_data_str, or NULL if
+// there is none.
+const char* pam_get_data_str(pam_handle_t *pamh, const char *name) {
+  const void *data = NULL;
+  if (pam_get_data(pamh, name, &data) != PAM_SUCCESS) {
+    return NULL;
+  }
+  return (const char*)data;
+}
@@ -19,16 +19,47 @@ package main
 
 char* argv_i(const char **argv, int i);
 void pam_syslog_str(pam_handle_t *pamh, int priority, const char *str);
+int pam_info_str(pam_handle_t *pamh, const char *str);
+int pam_get_item_str(pam_handle_t *pamh, int item, const char **str);
+int pam_set_data_str(pam_handle_t *pamh, const char *name, char *str);
+const char* pam_get_data_str(pam_handle_t *pamh, const char *name);
 */
 import "C"
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/syslog"
+	"time"
 	"unsafe"
+
+	"github.com/pardot/oidc"
 )
 
+// pamCodes maps pamCode to the PAM return codes.
+var pamCodes = map[pamCode]C.int{
+	pamSuccess:         C.PAM_SUCCESS,
+	pamAuthErr:         C.PAM_AUTH_ERR,
+	pamAuthInfoUnavail: C.PAM_AUTHINFO_UNAVAIL,
+	pamUserUnknown:     C.PAM_USER_UNKNOWN,
+	pamPermDenied:      C.PAM_PERM_DENIED,
+	pamAcctExpired:     C.PAM_ACCT_EXPIRED,
+	pamServiceErr:      C.PAM_SERVICE_ERR,
+	pamSystemErr:       C.PAM_SYSTEM_ERR,
+}
+
+// identityDataName is the name of the PAM module data under which the
+// identity verified during authentication is stored for later phases.
+const identityDataName = "pam_oidc_identity"
+
+// verifiedIdentity is the identity verified during authentication.
+type verifiedIdentity struct {
+	User   string       `json:"user"`
+	Claims *oidc.Claims `json:"claims"`
+}
+
 func main() {
 }
 
@@ -36,76 +67,452 @@ func main() {
 func pam_sm_authenticate_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C.char) C.int {
 	ctx := context.Background()
 
-	// Copy args to Go strings
-	args := make([]string, int(argc))
-	for i := 0; i < int(argc); i++ {
-		args[i] = C.GoString(C.argv_i(argv, C.int(i)))
-	}
-
 	// Parse config
-	cfg, err := configFromArgs(args)
+	cfg, err := pamConfig(pamh, argc, argv)
 	if err != nil {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to parse config: %v", err)
-		return C.PAM_SERVICE_ERR
+		return pamConfigFailure(pamh, nil, "auth", fmt.Errorf("failed to parse config: %v", err))
 	}
 
 	// Validate config
-	if cfg.Issuer == "" {
-		pamSyslog(pamh, syslog.LOG_ERR, "missing required option: issuer")
-		return C.PAM_SERVICE_ERR
-	} else if cfg.Aud == "" {
-		pamSyslog(pamh, syslog.LOG_ERR, "missing required option: aud")
-		return C.PAM_SERVICE_ERR
+	if err := cfg.validate(); err != nil {
+		return pamConfigFailure(pamh, cfg, "auth", err)
 	}
 
+	rec := pamAuditRecord(pamh, "auth")
+	code, err := authenticate(ctx, pamh, cfg, rec)
+	if err != nil {
+		pamLogFailure(pamh, rec, err)
+	}
+	pamAudit(pamh, cfg, rec, err)
+
+	return code
+}
+
+// authenticate authenticates the PAM user, recording the user and verified
+// claims in rec. The PAM result is returned, along with the reason for a
+// failure.
+func authenticate(ctx context.Context, pamh *C.pam_handle_t, cfg *config, rec *auditRecord) (C.int, error) {
 	// Get (or prompt for) user
 	var cUser *C.char
 	if errnum := C.pam_get_user(pamh, &cUser, nil); errnum != C.PAM_SUCCESS {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to get user: %v", pamStrError(pamh, errnum))
-		return errnum
+		return errnum, authErrorf(reasonPAM, "failed to get user: %v", pamStrError(pamh, errnum))
 	}
 
 	user := C.GoString(cUser)
 	if len(user) == 0 {
-		pamSyslog(pamh, syslog.LOG_WARNING, "empty user")
-		return C.PAM_USER_UNKNOWN
+		return C.PAM_USER_UNKNOWN, authErrorf(reasonUserMismatch, "empty user")
 	}
+	rec.User = user
 
-	// Get (or prompt for) password (token)
-	var cToken *C.char
-	if errnum := C.pam_get_authtok(pamh, C.PAM_AUTHTOK, &cToken, nil); errnum != C.PAM_SUCCESS {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to get token: %v", pamStrError(pamh, errnum))
-		return errnum
+	// Select the policy for the service and user, if any
+	cfg = pamPolicyConfig(pamh, cfg, rec)
+
+	var token string
+	if cfg.Flow == flowDevice {
+		// Obtain token with the device flow
+		var err error
+		token, err = deviceFlowToken(ctx, cfg, func(msg string) error {
+			return pamInfo(pamh, msg)
+		})
+		if err != nil {
+			err = authErrorf(reasonDeviceFlow, "failed to obtain token with device flow: %w", err)
+			return pamCodes[authenticateCode(err)], err
+		}
+	} else {
+		// Get (or prompt for) password (token)
+		var cToken *C.char
+		if errnum := C.pam_get_authtok(pamh, C.PAM_AUTHTOK, &cToken, nil); errnum != C.PAM_SUCCESS {
+			return errnum, authErrorf(reasonPAM, "failed to get token: %v", pamStrError(pamh, errnum))
+		}
+		token = C.GoString(cToken)
+	}
+
+	// Bound the time to verify the token, so an unresponsive issuer cannot
+	// hold up the login. Obtaining a token with the device flow waits for the
+	// user, so is bounded by the expiry of the device code instead.
+	authTimeout := cfg.AuthTimeout
+	if authTimeout == 0 {
+		authTimeout = defaultAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+
+	// Select the issuer that must verify the token, if several are trusted
+	if len(cfg.Issuers) > 0 {
+		issuer, err := peekIssuer(token)
+		if err != nil {
+			err = fmt.Errorf("failed to select issuer: %w", err)
+			return pamCodes[authenticateCode(err)], err
+		}
+
+		if cfg, err = cfg.forIssuer(issuer); err != nil {
+			err = fmt.Errorf("failed to select issuer: %w", err)
+			return pamCodes[authenticateCode(err)], err
+		}
+	}
+
+	p, err := cfg.provider()
+	if err != nil {
+		err = authErrorf(reasonConfig, "failed to configure issuer %s: %v", cfg.Issuer, err)
+		return pamCodes[authenticateCode(err)], err
+	}
+
+	var auth *authenticator
+	if cfg.TokenType == tokenTypeIntrospect {
+		auth, err = discoverIntrospectionAuthenticator(ctx, p, cfg.Aud, cfg.ClientID, cfg.ClientSecret)
+	} else {
+		auth, err = discoverAuthenticator(ctx, p, cfg.Aud)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to discover authenticator for issuer %s: %w", cfg.Issuer, err)
+		return pamCodes[authenticateCode(err)], err
+	}
+	auth.UserTemplates = cfg.UserTemplates
+	auth.CaseInsensitiveUser = cfg.UserMatch == userMatchCaseInsensitive
+	if cfg.UserMapFile != "" {
+		auth.UserMap = newUserMap(cfg.UserMapFile)
+		auth.UserMapOnly = cfg.UserMapMode == userMapOnly
+	}
+	auth.Logf = func(format string, a ...interface{}) {
+		pamSyslog(pamh, syslog.LOG_INFO, format, a...)
+	}
+	cfg.setAuthorization(auth, pamPolicyRequest(pamh, rec))
+	auth.MaxTokenAge = cfg.MaxTokenAge
+	auth.MaxAuthAge = cfg.MaxAuthAge
+	auth.ClockSkew = cfg.ClockSkew
+	if cfg.ReplayCache != "" {
+		auth.ReplayCache = newReplayCache(cfg.ReplayCache)
 	}
-	token := C.GoString(cToken)
 
-	auth, err := discoverAuthenticator(ctx, cfg.Issuer, cfg.Aud, cfg.HTTPProxy)
+	claims, err := auth.Authenticate(ctx, user, token)
+	rec.SetClaims(claims, cfg.GroupsClaimKeys)
 	if err != nil {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to discover authenticator: %v", err)
-		return C.PAM_AUTH_ERR
+		err = fmt.Errorf("failed to authenticate with issuer %s: %w", cfg.Issuer, err)
+		return pamCodes[authenticateCode(err)], err
 	}
-	auth.UserTemplate = cfg.UserTemplate
-	auth.GroupsClaimKey = cfg.GroupsClaimKey
-	auth.AuthorizedGroups = cfg.AuthorizedGroups
-	auth.RequireACRs = cfg.RequireACRs
 
-	if err := auth.Authenticate(ctx, user, token); err != nil {
-		pamSyslog(pamh, syslog.LOG_WARNING, "failed to authenticate: %v", err)
-		return C.PAM_AUTH_ERR
+	// Stash the verified identity for account management
+	if err := setIdentity(pamh, &verifiedIdentity{User: user, Claims: claims}); err != nil {
+		return C.PAM_SYSTEM_ERR, authErrorf(reasonPAM, "failed to store verified identity: %v", err)
 	}
 
-	return C.PAM_SUCCESS
+	return C.PAM_SUCCESS, nil
+}
+
+//export pam_sm_acct_mgmt_go
+func pam_sm_acct_mgmt_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C.char) C.int {
+	// Parse config
+	cfg, err := pamConfig(pamh, argc, argv)
+	if err != nil {
+		return pamConfigFailure(pamh, nil, "account", fmt.Errorf("failed to parse config: %v", err))
+	}
+
+	rec := pamAuditRecord(pamh, "account")
+	code, err := checkAccount(pamh, cfg, rec)
+	if err != nil {
+		pamLogFailure(pamh, rec, err)
+	}
+	// Ignoring the user is not a decision, so is not audited
+	if code != C.PAM_IGNORE {
+		pamAudit(pamh, cfg, rec, err)
+	}
+
+	return code
+}
+
+// checkAccount checks the account of the PAM user, recording the user and
+// verified claims in rec. The PAM result is returned, along with the reason
+// for a failure.
+func checkAccount(pamh *C.pam_handle_t, cfg *config, rec *auditRecord) (C.int, error) {
+	var cUser *C.char
+	if errnum := C.pam_get_user(pamh, &cUser, nil); errnum != C.PAM_SUCCESS {
+		return errnum, authErrorf(reasonPAM, "failed to get user: %v", pamStrError(pamh, errnum))
+	}
+	user := C.GoString(cUser)
+	rec.User = user
+
+	// Select the policy for the service and user, if any
+	cfg = pamPolicyConfig(pamh, cfg, rec)
+
+	// Account management can only be performed for users that were
+	// authenticated by this module.
+	ident, err := getIdentity(pamh)
+	if err != nil {
+		return C.PAM_SYSTEM_ERR, authErrorf(reasonPAM, "failed to load verified identity: %v", err)
+	} else if ident == nil {
+		pamSyslog(pamh, syslog.LOG_INFO, "no verified identity for user %q, ignoring", user)
+		return C.PAM_IGNORE, nil
+	}
+
+	if ident.User != user {
+		err := authErrorf(reasonUserMismatch, "verified identity is for user %q, but account is %q", ident.User, user)
+		return pamCodes[accountCode(err)], err
+	}
+
+	// Select the policy for the issuer that verified the token
+	if cfg, err = cfg.forIssuer(ident.Claims.Issuer); err != nil {
+		err = fmt.Errorf("account check failed: %w", err)
+		return pamCodes[accountCode(err)], err
+	}
+	rec.SetClaims(ident.Claims, cfg.GroupsClaimKeys)
+
+	auth := &authenticator{}
+	cfg.setAuthorization(auth, pamPolicyRequest(pamh, rec))
+
+	if err := auth.CheckAccount(ident.Claims); err != nil {
+		err = fmt.Errorf("account check failed: %w", err)
+		return pamCodes[accountCode(err)], err
+	}
+
+	return C.PAM_SUCCESS, nil
 }
 
 //export pam_sm_setcred_go
 func pam_sm_setcred_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C.char) C.int {
+	if flags&C.PAM_DELETE_CRED != 0 {
+		return C.PAM_IGNORE
+	}
+
+	return exportEnv(pamh, argc, argv, C.PAM_CRED_ERR)
+}
+
+//export pam_sm_open_session_go
+func pam_sm_open_session_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C.char) C.int {
+	return exportEnv(pamh, argc, argv, C.PAM_SESSION_ERR)
+}
+
+//export pam_sm_close_session_go
+func pam_sm_close_session_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C.char) C.int {
 	return C.PAM_IGNORE
 }
 
+// exportEnv exports the configured environment variables, rendered from the
+// identity verified during authentication, to the PAM environment. errCode is
+// returned if they cannot be exported.
+func exportEnv(pamh *C.pam_handle_t, argc C.int, argv **C.char, errCode C.int) C.int {
+	// Parse config
+	cfg, err := pamConfig(pamh, argc, argv)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to parse config: %v", err)
+		return C.PAM_SERVICE_ERR
+	}
+
+	// The environment can only be exported for users that were authenticated
+	// by this module.
+	ident, err := getIdentity(pamh)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to load verified identity: %v", err)
+		return C.PAM_SYSTEM_ERR
+	} else if ident == nil {
+		return C.PAM_IGNORE
+	}
+
+	user, err := pamGetItem(pamh, C.PAM_USER)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to get user: %v", err)
+		return errCode
+	} else if ident.User != user {
+		pamSyslog(pamh, syslog.LOG_WARNING, "verified identity is for user %q, but user is %q", ident.User, user)
+		return errCode
+	}
+
+	if cfg, err = cfg.forIssuer(ident.Claims.Issuer); err != nil {
+		pamSyslog(pamh, syslog.LOG_WARNING, "failed to export environment: %v", err)
+		return errCode
+	} else if len(cfg.Env) == 0 {
+		return C.PAM_IGNORE
+	}
+
+	env, err := renderEnv(cfg.Env, ident.Claims)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to export environment: %v", err)
+		return errCode
+	}
+
+	for _, nameValue := range env {
+		if err := pamPutenv(pamh, nameValue); err != nil {
+			pamSyslog(pamh, syslog.LOG_ERR, "failed to export environment: %v", err)
+			return errCode
+		}
+	}
+
+	return C.PAM_SUCCESS
+}
+
+// pamConfig parses config from the module arguments, selecting the profile
+// for the PAM service.
+func pamConfig(pamh *C.pam_handle_t, argc C.int, argv **C.char) (*config, error) {
+	// Copy args to Go strings
+	args := make([]string, int(argc))
+	for i := 0; i < int(argc); i++ {
+		args[i] = C.GoString(C.argv_i(argv, C.int(i)))
+	}
+
+	service, err := pamGetItem(pamh, C.PAM_SERVICE)
+	if err != nil {
+		return nil, fmt.Errorf("getting service: %v", err)
+	}
+
+	return configFromArgs(args, service)
+}
+
+// pamAuditRecord returns an audit record for a decision in phase, with the
+// PAM service and remote host and user.
+func pamAuditRecord(pamh *C.pam_handle_t, phase string) *auditRecord {
+	rec := &auditRecord{
+		Time:  time.Now().UTC(),
+		Phase: phase,
+	}
+
+	// The items are informational, so are recorded on a best effort basis
+	rec.Service, _ = pamGetItem(pamh, C.PAM_SERVICE)
+	rec.RHost, _ = pamGetItem(pamh, C.PAM_RHOST)
+	rec.RUser, _ = pamGetItem(pamh, C.PAM_RUSER)
+
+	return rec
+}
+
+// pamPolicyConfig returns the config for the service and user recorded in rec,
+// logging the policy selected, if any.
+func pamPolicyConfig(pamh *C.pam_handle_t, cfg *config, rec *auditRecord) *config {
+	cfg, policy := cfg.forRequest(rec.Service, rec.User)
+	if policy != nil {
+		pamSyslog(pamh, syslog.LOG_INFO, "using %s for service %q and user %q", policy.Name, rec.Service, rec.User)
+	}
+
+	return cfg
+}
+
+// pamPolicyRequest returns the PAM context for policies, from the items
+// recorded in rec.
+func pamPolicyRequest(pamh *C.pam_handle_t, rec *auditRecord) policyRequest {
+	// Items that are not set are empty in the policy
+	tty, _ := pamGetItem(pamh, C.PAM_TTY)
+
+	return policyRequest{
+		Service: rec.Service,
+		User:    rec.User,
+		RHost:   rec.RHost,
+		RUser:   rec.RUser,
+		TTY:     tty,
+	}
+}
+
+// pamLogFailure logs the failure of the decision in rec, with the remote host,
+// if any.
+func pamLogFailure(pamh *C.pam_handle_t, rec *auditRecord, err error) {
+	if rec.RHost != "" {
+		pamSyslog(pamh, failurePriority(err), "%v (rhost %s)", err, rec.RHost)
+		return
+	}
+
+	pamSyslog(pamh, failurePriority(err), "%v", err)
+}
+
+// pamConfigFailure logs and audits err, a failure to load or validate cfg in
+// phase, returning the PAM result. cfg is nil if it could not be loaded.
+func pamConfigFailure(pamh *C.pam_handle_t, cfg *config, phase string, err error) C.int {
+	err = authErrorf(reasonConfig, "%v", err)
+	pamSyslog(pamh, syslog.LOG_ERR, "%v", err)
+	pamAudit(pamh, cfg, pamAuditRecord(pamh, phase), err)
+
+	return C.PAM_SERVICE_ERR
+}
+
+// pamAudit records the result of the decision in rec, and writes it to the
+// audit log, if configured.
+func pamAudit(pamh *C.pam_handle_t, cfg *config, rec *auditRecord, err error) {
+	dest := auditDest(cfg)
+	if dest == "" {
+		return
+	}
+
+	rec.SetResult(err)
+	if err := writeAuditRecord(dest, rec); err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to write audit record: %v", err)
+	}
+}
+
+// setIdentity stores ident as PAM module data so it is available to later
+// phases within the same PAM transaction.
+func setIdentity(pamh *C.pam_handle_t, ident *verifiedIdentity) error {
+	data, err := json.Marshal(ident)
+	if err != nil {
+		return err
+	}
+
+	cname := C.CString(identityDataName)
+	defer C.free(unsafe.Pointer(cname))
+
+	// Ownership of cdata passes to PAM, which frees it on cleanup
+	cdata := C.CString(string(data))
+	if errnum := C.pam_set_data_str(pamh, cname, cdata); errnum != C.PAM_SUCCESS {
+		C.free(unsafe.Pointer(cdata))
+		return errors.New(pamStrError(pamh, errnum))
+	}
+
+	return nil
+}
+
+// getIdentity returns the identity stored by setIdentity, or nil if there is
+// none.
+func getIdentity(pamh *C.pam_handle_t) (*verifiedIdentity, error) {
+	cname := C.CString(identityDataName)
+	defer C.free(unsafe.Pointer(cname))
+
+	cdata := C.pam_get_data_str(pamh, cname)
+	if cdata == nil {
+		return nil, nil
+	}
+
+	ident := new(verifiedIdentity)
+	if err := json.Unmarshal([]byte(C.GoString(cdata)), ident); err != nil {
+		return nil, err
+	}
+
+	return ident, nil
+}
+
+// pamGetItem returns the string PAM item, or an empty string if it is not set.
+func pamGetItem(pamh *C.pam_handle_t, item C.int) (string, error) {
+	var cstr *C.char
+	if errnum := C.pam_get_item_str(pamh, item, &cstr); errnum != C.PAM_SUCCESS {
+		return "", errors.New(pamStrError(pamh, errnum))
+	}
+
+	return C.GoString(cstr), nil
+}
+
+// pamPutenv sets the PAM environment variable in nameValue, of the form
+// NAME=value.
+func pamPutenv(pamh *C.pam_handle_t, nameValue string) error {
+	cstr := C.CString(nameValue)
+	defer C.free(unsafe.Pointer(cstr))
+
+	if errnum := C.pam_putenv(pamh, cstr); errnum != C.PAM_SUCCESS {
+		return errors.New(pamStrError(pamh, errnum))
+	}
+
+	return nil
+}
+
 func pamStrError(pamh *C.pam_handle_t, errnum C.int) string {
 	return C.GoString(C.pam_strerror(pamh, errnum))
 }
 
+// pamInfo shows an informational message to the user through the PAM
+// conversation.
+func pamInfo(pamh *C.pam_handle_t, msg string) error {
+	cstr := C.CString(msg)
+	defer C.free(unsafe.Pointer(cstr))
+
+	if errnum := C.pam_info_str(pamh, cstr); errnum != C.PAM_SUCCESS {
+		return errors.New(pamStrError(pamh, errnum))
+	}
+
+	return nil
+}
+
 func pamSyslog(pamh *C.pam_handle_t, priority syslog.Priority, format string, a ...interface{}) {
 	cstr := C.CString(fmt.Sprintf(format, a...))
 	defer C.free(unsafe.Pointer(cstr))
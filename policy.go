@@ -0,0 +1,107 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// policyRequest is the PAM context a policy is evaluated in, available to the
+// policy as `request`.
+type policyRequest struct {
+	Service string
+	User    string
+	RHost   string
+	RUser   string
+	TTY     string
+}
+
+// vars returns the request as a policy variable.
+func (r policyRequest) vars() map[string]string {
+	return map[string]string{
+		"service": r.Service,
+		"user":    r.User,
+		"rhost":   r.RHost,
+		"ruser":   r.RUser,
+		"tty":     r.TTY,
+	}
+}
+
+// newPolicyEnv returns the environment of policies, which declares the
+// verified token claims as `claims`, and the PAM context as `request`.
+func newPolicyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.StringType)),
+	)
+}
+
+// policyCache caches compiled policies by their expression, so each policy is
+// compiled once in a process.
+var policyCache = struct {
+	sync.Mutex
+	env      *cel.Env
+	programs map[string]cel.Program
+}{
+	programs: make(map[string]cel.Program),
+}
+
+// compilePolicy parses and type-checks the CEL expression of a policy, which
+// must evaluate to a bool.
+func compilePolicy(expr string) (cel.Program, error) {
+	policyCache.Lock()
+	defer policyCache.Unlock()
+
+	if prg, ok := policyCache.programs[expr]; ok {
+		return prg, nil
+	}
+
+	if policyCache.env == nil {
+		env, err := newPolicyEnv()
+		if err != nil {
+			return nil, fmt.Errorf("creating policy environment: %v", err)
+		}
+		policyCache.env = env
+	}
+	env := policyCache.env
+
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid policy: %v", iss.Err())
+	} else if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("invalid policy: must evaluate to bool, not %v", ast.OutputType())
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	policyCache.programs[expr] = prg
+
+	return prg, nil
+}
+
+// evalPolicy evaluates the compiled policy with the claims, as returned by
+// claimsMap, and request. An error evaluating the policy, such as for a missing
+// claim, denies access.
+func evalPolicy(prg cel.Program, claims map[string]interface{}, req policyRequest) error {
+	out, _, err := prg.Eval(map[string]interface{}{
+		"claims":  claims,
+		"request": req.vars(),
+	})
+	if err != nil {
+		return authErrorf(reasonPolicyDenied, "evaluating policy: %v", err)
+	}
+
+	if allowed, ok := out.Value().(bool); !ok || !allowed {
+		return authErrorf(reasonPolicyDenied, "denied by policy")
+	}
+
+	return nil
+}
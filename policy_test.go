@@ -0,0 +1,168 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pardot/oidc"
+)
+
+func TestCompilePolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{
+			name:   "valid policy",
+			policy: `'sre' in claims.groups && request.service == 'sshd' && claims.amr.exists(m, m == 'mfa')`,
+		},
+		{
+			name:    "syntax error",
+			policy:  `'sre' in claims.groups &&`,
+			wantErr: "invalid policy: ERROR: <input>:1:26: Syntax error",
+		},
+		{
+			name:    "undeclared variable",
+			policy:  `user == 'jdoe'`,
+			wantErr: "undeclared reference to 'user'",
+		},
+		{
+			name:    "type error",
+			policy:  `request.service == 1`,
+			wantErr: "found no matching overload for '_==_'",
+		},
+		{
+			name:    "not a bool",
+			policy:  `request.service`,
+			wantErr: "invalid policy: must evaluate to bool, not string",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compilePolicy(tc.policy)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	const policy = `'sre' in claims.groups && request.service == 'sshd' && claims.amr.exists(m, m == 'mfa')`
+
+	sshd := policyRequest{Service: "sshd", User: "jdoe", RHost: "192.0.2.1", TTY: "ssh"}
+
+	cases := []struct {
+		name    string
+		policy  string
+		claims  *oidc.Claims
+		request policyRequest
+		wantErr string
+	}{
+		{
+			name:   "allowed",
+			policy: policy,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"engineering", "sre"},
+					"amr":    []interface{}{"pwd", "mfa"},
+				},
+			},
+			request: sshd,
+		},
+		{
+			name:   "denied by claims",
+			policy: policy,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"engineering", "sre"},
+					"amr":    []interface{}{"pwd"},
+				},
+			},
+			request: sshd,
+			wantErr: "denied by policy",
+		},
+		{
+			name:   "denied by request",
+			policy: policy,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Extra: map[string]interface{}{
+					"groups": []interface{}{"engineering", "sre"},
+					"amr":    []interface{}{"pwd", "mfa"},
+				},
+			},
+			request: policyRequest{Service: "sudo", User: "root"},
+			wantErr: "denied by policy",
+		},
+		{
+			name:   "missing claim",
+			policy: policy,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Extra: map[string]interface{}{
+					"amr": []interface{}{"pwd", "mfa"},
+				},
+			},
+			request: sshd,
+			wantErr: "evaluating policy: no such key: groups",
+		},
+		{
+			name:   "standard and numeric claims",
+			policy: `claims.sub == request.user && claims.level >= 2.0 && request.rhost.startsWith('192.0.2.')`,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+				Extra: map[string]interface{}{
+					"level": 3,
+				},
+			},
+			request: sshd,
+		},
+		{
+			name:   "invalid policy",
+			policy: `request.service`,
+			claims: &oidc.Claims{
+				Subject: "jdoe",
+			},
+			request: sshd,
+			wantErr: "invalid policy",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &authenticator{}
+			auth.Policy = tc.policy
+			auth.Request = tc.request
+
+			err := auth.authorize(tc.claims)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if tc.wantErr == "denied by policy" && !errors.Is(err, ErrPolicyDenied) {
+				t.Errorf("want errors.Is(err, ErrPolicyDenied), got %v", err)
+			}
+		})
+	}
+}
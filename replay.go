@@ -0,0 +1,152 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// defaultReplayTTL is how long tokens without an expiry are remembered.
+const defaultReplayTTL = 24 * time.Hour
+
+// errTokenReplayed is returned when a token has already been used.
+var errTokenReplayed = errors.New("token has already been used")
+
+// replayCache records the tokens that have been used in a file, so each token
+// can only be used once, even across processes. Tokens are forgotten once
+// they expire.
+//
+// Because a modified file could allow tokens to be replayed, the file and its
+// directory must be owned by the current user or root, and must not be
+// writable by others.
+type replayCache struct {
+	path string
+
+	// clock returns the current time. time.Now is used by default.
+	clock func() time.Time
+}
+
+func newReplayCache(path string) *replayCache {
+	return &replayCache{path: path}
+}
+
+// replayID returns the identifier under which a token is recorded: its jti
+// claim, scoped to the issuer, or, if it has none, the token itself. Only a
+// hash of the identifier is recorded.
+func replayID(claims *oidc.Claims, token string) string {
+	var id string
+	if jti, ok := claims.Extra["jti"].(string); ok && jti != "" {
+		id = "jti\x00" + claims.Issuer + "\x00" + jti
+	} else {
+		id = "token\x00" + token
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Use records that the token identified by id has been used, and is
+// remembered until expires. If the token has already been used,
+// errTokenReplayed is returned.
+func (r *replayCache) Use(id string, expires time.Time) error {
+	clock := time.Now
+	if r.clock != nil {
+		clock = r.clock
+	}
+	now := clock()
+
+	if expires.IsZero() {
+		expires = now.Add(defaultReplayTTL)
+	}
+
+	dir := filepath.Dir(r.path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("opening replay cache: %v", err)
+	} else if err := checkOwnership(dir, fi); err != nil {
+		return err
+	}
+
+	// The entries are replaced atomically, so a separate lock file serializes
+	// updates across processes.
+	lock, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening replay cache lock: %v", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("locking replay cache: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	entries, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	for k, exp := range entries {
+		if now.Unix() >= exp {
+			delete(entries, k)
+		}
+	}
+
+	if _, ok := entries[id]; ok {
+		return errTokenReplayed
+	}
+	entries[id] = expires.Unix()
+
+	return r.write(entries)
+}
+
+// read returns the recorded tokens, mapped to when they expire.
+func (r *replayCache) read() (map[string]int64, error) {
+	entries := make(map[string]int64)
+
+	f, err := os.Open(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening replay cache: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("opening replay cache: %v", err)
+	} else if err := checkOwnership(r.path, fi); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decoding replay cache: %v", err)
+	}
+
+	return entries, nil
+}
+
+func (r *replayCache) write(entries map[string]int64) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(r.path, data); err != nil {
+		return fmt.Errorf("writing replay cache: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "replay.json")
+
+	cache := newReplayCache(path)
+	cache.clock = func() time.Time { return now }
+
+	if err := cache.Use("a", now.Add(time.Hour)); err != nil {
+		t.Fatalf("want no err, got %v", err)
+	}
+	if err := cache.Use("b", time.Time{}); err != nil {
+		t.Fatalf("want no err, got %v", err)
+	}
+
+	// A separate instance, as in another process, sees the recorded tokens
+	other := newReplayCache(path)
+	other.clock = func() time.Time { return now }
+	if err := other.Use("a", now.Add(time.Hour)); !errors.Is(err, errTokenReplayed) {
+		t.Errorf("want replayed err, got %v", err)
+	}
+
+	// Expired tokens are forgotten
+	other.clock = func() time.Time { return now.Add(2 * time.Hour) }
+	if err := other.Use("a", now.Add(3*time.Hour)); err != nil {
+		t.Errorf("want no err after expiry, got %v", err)
+	}
+
+	// Tokens without an expiry are remembered for the default TTL
+	if err := other.Use("b", time.Time{}); !errors.Is(err, errTokenReplayed) {
+		t.Errorf("want replayed err, got %v", err)
+	}
+	other.clock = func() time.Time { return now.Add(defaultReplayTTL) }
+	if err := other.Use("b", time.Time{}); err != nil {
+		t.Errorf("want no err after default TTL, got %v", err)
+	}
+}
+
+func TestReplayCacheConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+
+	const n = 10
+	errs := make(chan error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- newReplayCache(path).Use("token", time.Now().Add(time.Hour))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		} else if !errors.Is(err, errTokenReplayed) {
+			t.Errorf("want replayed err, got %v", err)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("want token to be accepted once, got %d", accepted)
+	}
+}
+
+func TestReplayCachePermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "replay.json")
+
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := newReplayCache(path).Use("a", time.Time{}); err == nil || !strings.Contains(err.Error(), "must not be writable by group or others") {
+		t.Errorf("want permission err for directory, got %v", err)
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := newReplayCache(path).Use("a", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := newReplayCache(path).Use("b", time.Time{}); err == nil || !strings.Contains(err.Error(), "must not be writable by group or others") {
+		t.Errorf("want permission err for file, got %v", err)
+	}
+}
+
+func TestReplayID(t *testing.T) {
+	withJTI := &oidc.Claims{Issuer: "https://example.com", Extra: map[string]interface{}{"jti": "abc"}}
+	otherIssuer := &oidc.Claims{Issuer: "https://other.example.com", Extra: map[string]interface{}{"jti": "abc"}}
+	withoutJTI := &oidc.Claims{Issuer: "https://example.com"}
+
+	if replayID(withJTI, "token-1") != replayID(withJTI, "token-2") {
+		t.Error("want tokens with the same jti to share an id")
+	}
+	if replayID(withJTI, "token-1") == replayID(otherIssuer, "token-1") {
+		t.Error("want jti to be scoped to the issuer")
+	}
+	if replayID(withoutJTI, "token-1") == replayID(withoutJTI, "token-2") {
+		t.Error("want tokens without a jti to be identified by the token")
+	}
+	if id := replayID(withoutJTI, "token-1"); strings.Contains(id, "token-1") {
+		t.Errorf("want token to be hashed, got %s", id)
+	}
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+
+	auth, err := discoverAuthenticator(ctx, issuer.provider(), "valid-aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ReplayCache = newReplayCache(filepath.Join(t.TempDir(), "replay.json"))
+
+	token := mustJWT(t, issuer.signer, oidc.Claims{
+		Issuer:   issuer.srv.URL,
+		Subject:  "jdoe",
+		Audience: []string{"valid-aud"},
+		Expiry:   oidc.UnixTime(time.Now().Add(10 * time.Minute).Unix()),
+		Extra:    map[string]interface{}{"jti": "abc"},
+	})
+
+	// A rejected attempt does not use the token
+	if _, err := auth.Authenticate(ctx, "invalid", token); err == nil {
+		t.Fatal("want err for invalid user, got none")
+	}
+
+	if _, err := auth.Authenticate(ctx, "jdoe", token); err != nil {
+		t.Fatalf("want no err, got %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, "jdoe", token); !errors.Is(err, errTokenReplayed) {
+		t.Errorf("want replayed err, got %v", err)
+	}
+}
+
+func TestAuthenticateReplayWithinLeeway(t *testing.T) {
+	ctx := context.Background()
+
+	issuer := newTestIssuer(t)
+
+	auth, err := discoverAuthenticator(ctx, issuer.provider(), "valid-aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ReplayCache = newReplayCache(filepath.Join(t.TempDir(), "replay.json"))
+
+	// The token has expired, but is still accepted within the leeway
+	token := mustJWT(t, issuer.signer, oidc.Claims{
+		Issuer:   issuer.srv.URL,
+		Subject:  "jdoe",
+		Audience: []string{"valid-aud"},
+		Expiry:   oidc.UnixTime(time.Now().Add(-30 * time.Second).Unix()),
+		Extra:    map[string]interface{}{"jti": "abc"},
+	})
+
+	if _, err := auth.Authenticate(ctx, "jdoe", token); err != nil {
+		t.Fatalf("want no err, got %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, "jdoe", token); !errors.Is(err, errTokenReplayed) {
+		t.Errorf("want replayed err, got %v", err)
+	}
+}
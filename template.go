@@ -0,0 +1,311 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+
+	"github.com/pardot/oidc"
+)
+
+// templateFuncs are the functions available to templates rendered with the
+// token claims. Functions take the value they operate on last, so they can be
+// used in pipelines, e.g. `{{.Extra.email | lower | trimSuffix "@example.com"}}`.
+var templateFuncs = template.FuncMap{
+	"trimPrefix":   func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix":   func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"lower":        strings.ToLower,
+	"upper":        strings.ToUpper,
+	"replace":      func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"regexReplace": regexReplace,
+	"split":        func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":         join,
+	"initial":      initial,
+	"default":      defaultValue,
+	// claim is bound to the claims being rendered by bindClaimFunc when the
+	// template is parsed.
+	"claim": func(path string) interface{} { return nil },
+}
+
+// templateCache caches parsed templates by their text, as the same templates
+// are rendered for every authentication in a process.
+var templateCache = struct {
+	sync.Mutex
+	templates map[string]*template.Template
+}{
+	templates: make(map[string]*template.Template),
+}
+
+// parseClaimsTemplate parses a template to be rendered with token claims.
+func parseClaimsTemplate(text string) (*template.Template, error) {
+	templateCache.Lock()
+	defer templateCache.Unlock()
+
+	if tmpl, ok := templateCache.templates[text]; ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	bindClaimFunc(tmpl.Tree.Root)
+	templateCache.templates[text] = tmpl
+
+	return tmpl, nil
+}
+
+// claimsData is the data templates are executed with. The claims are
+// embedded, so templates can refer to them directly, e.g. `{{.Subject}}`.
+type claimsData struct {
+	*oidc.Claims
+
+	// m is the claims as a map, decoded when first needed.
+	m map[string]interface{}
+}
+
+// Claim returns the claim at path, or nil if there is none. Calls to the
+// claim function are bound to it by bindClaimFunc.
+func (d *claimsData) Claim(path string) (interface{}, error) {
+	if d.m == nil {
+		m, err := claimsMap(d.Claims)
+		if err != nil {
+			return nil, err
+		}
+		d.m = m
+	}
+
+	return lookupClaim(d.m, path), nil
+}
+
+// bindClaimFunc replaces calls to the claim function in the parse tree at node
+// with calls to $.Claim, so a cached template looks up the claims of each
+// execution without being copied.
+func bindClaimFunc(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			bindClaimFunc(n)
+		}
+	case *parse.ActionNode:
+		bindClaimFunc(node.Pipe)
+	case *parse.IfNode:
+		bindClaimFunc(&node.BranchNode)
+	case *parse.RangeNode:
+		bindClaimFunc(&node.BranchNode)
+	case *parse.WithNode:
+		bindClaimFunc(&node.BranchNode)
+	case *parse.BranchNode:
+		bindClaimFunc(node.Pipe)
+		bindClaimFunc(node.List)
+		bindClaimFunc(node.ElseList)
+	case *parse.TemplateNode:
+		bindClaimFunc(node.Pipe)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			bindClaimFunc(cmd)
+		}
+	case *parse.ChainNode:
+		bindClaimFunc(node.Node)
+	case *parse.CommandNode:
+		for i, arg := range node.Args {
+			if ident, ok := arg.(*parse.IdentifierNode); ok && ident.Ident == "claim" {
+				node.Args[i] = &parse.VariableNode{
+					NodeType: parse.NodeVariable,
+					Pos:      ident.Pos,
+					Ident:    []string{"$", "Claim"},
+				}
+				continue
+			}
+			bindClaimFunc(arg)
+		}
+	}
+}
+
+// executeClaimsTemplate renders tmpl, which must have been parsed by
+// parseClaimsTemplate, with claims.
+func executeClaimsTemplate(tmpl *template.Template, claims *oidc.Claims) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, &claimsData{Claims: claims}); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// renderClaimsTemplate renders the template text with claims.
+func renderClaimsTemplate(text string, claims *oidc.Claims) (string, error) {
+	tmpl, err := parseClaimsTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %v", err)
+	}
+
+	s, err := executeClaimsTemplate(tmpl, claims)
+	if err != nil {
+		return "", fmt.Errorf("executing template: %v", err)
+	}
+
+	return s, nil
+}
+
+// lookupClaim returns the claim at the path, such as `realm_access.roles`, or
+// nil if there is none or the path is invalid.
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	keys, err := parseClaimPath(path)
+	if err != nil {
+		return nil
+	}
+
+	var v interface{} = claims
+	for _, key := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+
+	return v
+}
+
+// parseClaimPath parses the path to a nested claim into its keys. Keys are
+// separated by dots, and keys containing dots can be quoted in brackets, as in
+// JSON paths: `resource_access["my.client"].roles`. A leading `$.` is ignored.
+func parseClaimPath(path string) ([]string, error) {
+	var keys []string
+
+	s := strings.TrimPrefix(path, "$.")
+	for {
+		if strings.HasPrefix(s, "[") {
+			if len(s) < 2 || (s[1] != '"' && s[1] != '\'') {
+				return nil, fmt.Errorf("invalid claim path %q: expected quoted key after [", path)
+			}
+			end := strings.IndexByte(s[2:], s[1])
+			if end < 0 || !strings.HasPrefix(s[2+end+1:], "]") {
+				return nil, fmt.Errorf("invalid claim path %q: unterminated [", path)
+			}
+			keys = append(keys, s[2:2+end])
+			s = s[2+end+2:]
+		} else {
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid claim path %q: empty key", path)
+			}
+			keys = append(keys, s[:end])
+			s = s[end:]
+		}
+
+		if s == "" {
+			return keys, nil
+		} else if strings.HasPrefix(s, ".") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "[") {
+			return nil, fmt.Errorf("invalid claim path %q: expected . or [", path)
+		}
+	}
+}
+
+// regexpCache caches compiled regular expressions by their pattern, as the
+// same patterns are used for every authentication in a process.
+var regexpCache = struct {
+	sync.Mutex
+	regexps map[string]*regexp.Regexp
+}{
+	regexps: make(map[string]*regexp.Regexp),
+}
+
+// compileRegexp compiles pattern, or returns it from the cache.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+
+	if re, ok := regexpCache.regexps[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.regexps[pattern] = re
+
+	return re, nil
+}
+
+// regexReplace replaces matches of the regular expression pattern in s with
+// repl, which may refer to submatches as $1.
+func regexReplace(pattern, repl, s string) (string, error) {
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// join joins the elements of list, which is usually a list claim, with sep.
+func join(sep string, list interface{}) string {
+	switch list := list.(type) {
+	case []string:
+		return strings.Join(list, sep)
+	case []interface{}:
+		elems := make([]string, 0, len(list))
+		for _, elem := range list {
+			elems = append(elems, fmt.Sprint(elem))
+		}
+		return strings.Join(elems, sep)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(list)
+	}
+}
+
+// initial returns the first character of s.
+func initial(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return ""
+	}
+
+	return s[:size]
+}
+
+// defaultValue returns value, or def if value is empty.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		if rv.Len() == 0 {
+			return def
+		}
+	}
+
+	return value
+}
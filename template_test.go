@@ -0,0 +1,275 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+func TestRenderClaimsTemplate(t *testing.T) {
+	// Claims as issued by Okta, Azure AD and Google, trimmed to the claims
+	// that are useful for mapping users.
+	okta := &oidc.Claims{
+		Issuer:  "https://example.okta.com",
+		Subject: "00u1abcdEFGH2ijkl3m4",
+		Extra: map[string]interface{}{
+			"preferred_username": "Jane.Doe@Corp.COM",
+			"email":              "Jane.Doe@Corp.COM",
+			"groups":             []interface{}{"Everyone", "Engineering"},
+		},
+	}
+	azure := &oidc.Claims{
+		Issuer:  "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0",
+		Subject: "AAAAAAAAAAAAAAAAAAAAAIkzqFVrSaSaFHy782bbtaQ",
+		Extra: map[string]interface{}{
+			"oid":         "00000000-0000-0000-66f3-3332eca7ea81",
+			"upn":         "Jane.Doe@Corp.COM",
+			"name":        "Jane Doe",
+			"given_name":  "Jane",
+			"family_name": "Doe",
+			"roles":       []interface{}{"Admin"},
+		},
+	}
+	google := &oidc.Claims{
+		Issuer:  "https://accounts.google.com",
+		Subject: "110169484474386276334",
+		Extra: map[string]interface{}{
+			"email":          "jdoe@example.com",
+			"email_verified": true,
+			"hd":             "example.com",
+		},
+	}
+	keycloak := &oidc.Claims{
+		Issuer:  "https://sso.example.com/realms/corp",
+		Subject: "f1a2b3c4-d5e6-7890-abcd-ef0123456789",
+		Extra: map[string]interface{}{
+			"preferred_username": "jdoe",
+			"realm_access": map[string]interface{}{
+				"roles": []interface{}{"offline_access", "admin"},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		claims   *oidc.Claims
+		template string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "okta username to lower case",
+			claims:   okta,
+			template: `{{.Extra.preferred_username | lower | trimSuffix "@corp.com"}}`,
+			want:     "jane.doe",
+		},
+		{
+			name:     "okta username to underscored name",
+			claims:   okta,
+			template: `{{.Extra.preferred_username | lower | regexReplace "@.*$" "" | replace "." "_"}}`,
+			want:     "jane_doe",
+		},
+		{
+			name:     "okta username to first initial and last name",
+			claims:   okta,
+			template: `{{$name := split "." (index (split "@" (lower .Extra.preferred_username)) 0)}}{{index $name 0 | initial}}{{index $name 1}}`,
+			want:     "jdoe",
+		},
+		{
+			name:     "okta username with regex submatches",
+			claims:   okta,
+			template: `{{.Extra.preferred_username | lower | regexReplace "^(.)[^.]*\\.([^@]*)@.*$" "${1}${2}"}}`,
+			want:     "jdoe",
+		},
+		{
+			name:     "azure given and family names",
+			claims:   azure,
+			template: `{{.Extra.given_name | initial | lower}}{{.Extra.family_name | lower}}`,
+			want:     "jdoe",
+		},
+		{
+			name:     "azure upn with index",
+			claims:   azure,
+			template: `{{index (split "@" (claim "upn" | lower)) 0}}`,
+			want:     "jane.doe",
+		},
+		{
+			name:     "azure name in upper case",
+			claims:   azure,
+			template: `{{.Extra.name | upper | replace " " "_"}}`,
+			want:     "JANE_DOE",
+		},
+		{
+			name:     "google email",
+			claims:   google,
+			template: `{{if .Extra.email_verified}}{{.Extra.email | trimSuffix (printf "@%s" (claim "hd"))}}{{end}}`,
+			want:     "jdoe",
+		},
+		{
+			name:     "google missing claim with default",
+			claims:   google,
+			template: `{{claim "preferred_username" | default .Subject}}`,
+			want:     "110169484474386276334",
+		},
+		{
+			name:     "standard claim",
+			claims:   google,
+			template: `{{claim "sub"}}`,
+			want:     "110169484474386276334",
+		},
+		{
+			name:     "keycloak nested claim",
+			claims:   keycloak,
+			template: `{{claim "realm_access.roles" | join ","}}`,
+			want:     "offline_access,admin",
+		},
+		{
+			name:     "missing nested claim",
+			claims:   keycloak,
+			template: `{{claim "resource_access.account.roles" | join ","}}`,
+			want:     "",
+		},
+		{
+			name:     "invalid regex",
+			claims:   okta,
+			template: `{{.Extra.email | regexReplace "(" ""}}`,
+			wantErr:  "executing template",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := renderClaimsTemplate(tc.template, tc.claims)
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClaimsTemplateCache(t *testing.T) {
+	const text = `{{claim "email"}}`
+
+	first, err := parseClaimsTemplate(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := parseClaimsTemplate(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("want parsed template to be cached")
+	}
+
+	// The cached template is rendered with the claims of each execution
+	for _, email := range []string{"jdoe@example.com", "jane@example.com"} {
+		got, err := executeClaimsTemplate(first, &oidc.Claims{Extra: map[string]interface{}{"email": email}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != email {
+			t.Errorf("want %q, got %q", email, got)
+		}
+	}
+}
+
+func TestClaimsTemplateConcurrent(t *testing.T) {
+	// claim is bound in nested pipelines and changes of dot
+	tmpl, err := parseClaimsTemplate(`{{with .Extra.name}}{{claim "email"}}{{end}}:{{range claim "groups"}}{{(claim "email") | upper}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		email := fmt.Sprintf("user%d@example.com", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			got, err := executeClaimsTemplate(tmpl, &oidc.Claims{Extra: map[string]interface{}{
+				"name":   "User",
+				"email":  email,
+				"groups": []interface{}{"admins"},
+			}})
+			if err != nil {
+				t.Error(err)
+			} else if want := email + ":" + strings.ToUpper(email); got != want {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRegexReplaceCache(t *testing.T) {
+	const pattern = "@.*$"
+
+	if _, err := regexReplace(pattern, "", "jdoe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := compileRegexp(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := compileRegexp(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("want compiled regexp to be cached")
+	}
+}
+
+func TestParseClaimPath(t *testing.T) {
+	cases := []struct {
+		path    string
+		want    []string
+		wantErr string
+	}{
+		{path: "groups", want: []string{"groups"}},
+		{path: "realm_access.roles", want: []string{"realm_access", "roles"}},
+		{path: "$.realm_access.roles", want: []string{"realm_access", "roles"}},
+		{path: `resource_access["my.client"].roles`, want: []string{"resource_access", "my.client", "roles"}},
+		{path: `resource_access['my-client'].roles`, want: []string{"resource_access", "my-client", "roles"}},
+		{path: `["https://example.com/groups"]`, want: []string{"https://example.com/groups"}},
+		{path: "", wantErr: "empty key"},
+		{path: "realm_access..roles", wantErr: "empty key"},
+		{path: "realm_access.", wantErr: "empty key"},
+		{path: "resource_access[client]", wantErr: "expected quoted key"},
+		{path: `resource_access["client"`, wantErr: "unterminated ["},
+		{path: `resource_access["client"]roles`, wantErr: "expected . or ["},
+	}
+
+	for _, tc := range cases {
+		got, err := parseClaimPath(tc.path)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%q: want no err, got %v", tc.path, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: want err %v, got %v", tc.path, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%q: want err %v, got none", tc.path, tc.wantErr)
+		} else if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%q: unexpected keys (-want +got):\n%s", tc.path, diff)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays are the names of the days of the week in time windows.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow restricts members of the groups matching a pattern to hours on
+// days of the week, of the form `<group>@<days>/<start>-<end>[/<zone>]`, such
+// as `oncall@mon-fri/09:00-17:30/America/New_York`.
+//
+// Days are `*` for every day, or `+`-separated days and ranges of days, such
+// as `mon-fri+sun`. A window whose end is before its start crosses midnight,
+// and the early hours belong to the day before. The time zone is a name from
+// the IANA time zone database, or the local time zone if omitted.
+type timeWindow struct {
+	groupRestriction
+	text string
+	days [7]bool
+	// start and end are minutes since midnight.
+	start int
+	end   int
+	loc   *time.Location
+}
+
+// parseTimeWindow parses a single time window.
+func parseTimeWindow(s string) (*timeWindow, error) {
+	w := &timeWindow{text: s, loc: time.Local}
+
+	r, window, err := parseGroupRestriction(s, "<days>/<start>-<end>")
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", s, err)
+	}
+	w.groupRestriction = r
+
+	parts := strings.SplitN(window, "/", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid time window %q: expected <group>@<days>/<start>-<end>", s)
+	}
+
+	if err := w.parseDays(parts[0]); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", s, err)
+	}
+
+	hours := strings.SplitN(parts[1], "-", 2)
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("invalid time window %q: expected <start>-<end>", s)
+	}
+	if w.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", s, err)
+	}
+	if w.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", s, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid time window %q: empty hours", s)
+	}
+
+	if len(parts) == 3 {
+		if w.loc, err = time.LoadLocation(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %v", s, err)
+		}
+	}
+
+	return w, nil
+}
+
+// parseTimeWindows parses each of the time windows in list.
+func parseTimeWindows(list []string) ([]*timeWindow, error) {
+	windows := make([]*timeWindow, 0, len(list))
+	for _, s := range list {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+func (w *timeWindow) parseDays(s string) error {
+	if s == "*" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+		return nil
+	}
+
+	for _, r := range strings.Split(s, "+") {
+		bounds := strings.SplitN(r, "-", 2)
+
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return fmt.Errorf("unknown day: %v", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return fmt.Errorf("unknown day: %v", bounds[1])
+			}
+		}
+
+		// Ranges may wrap around the end of the week, e.g. fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseTimeOfDay parses a time of day, such as `09:30`, as minutes since
+// midnight. `24:00` is the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %v", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t is within the window.
+func (w *timeWindow) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+
+	// The window crosses midnight
+	if minute >= w.start {
+		return w.days[day]
+	} else if minute < w.end {
+		return w.days[(day+6)%7]
+	}
+	return false
+}
+
+// claimTime returns a claim as a time: either a number of seconds since the
+// epoch, like `exp`, or an RFC 3339 string.
+func claimTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, true
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(n, 0), true
+		}
+	}
+
+	return time.Time{}, false
+}
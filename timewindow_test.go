@@ -0,0 +1,196 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+func TestTimeWindow(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2021-06-07 is a Monday
+	monday := func(hour, min int) time.Time {
+		return time.Date(2021, 6, 7, hour, min, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{window: "oncall@*/09:00-17:00/UTC", t: monday(9, 0), want: true},
+		{window: "oncall@*/09:00-17:00/UTC", t: monday(16, 59), want: true},
+		{window: "oncall@*/09:00-17:00/UTC", t: monday(17, 0), want: false},
+		{window: "oncall@*/09:00-17:00/UTC", t: monday(8, 59), want: false},
+		{window: "oncall@mon-fri/09:00-17:00/UTC", t: monday(12, 0), want: true},
+		{window: "oncall@tue-fri/09:00-17:00/UTC", t: monday(12, 0), want: false},
+		{window: "oncall@sat+sun+mon/09:00-17:00/UTC", t: monday(12, 0), want: true},
+		{window: "oncall@fri-mon/09:00-17:00/UTC", t: monday(12, 0), want: true},
+		{window: "oncall@MON/00:00-24:00/UTC", t: monday(23, 59), want: true},
+		// 12:00 UTC is 08:00 in New York
+		{window: "oncall@mon/09:00-17:00/America/New_York", t: monday(12, 0), want: false},
+		{window: "oncall@mon/09:00-17:00/America/New_York", t: monday(13, 0), want: true},
+		// Windows crossing midnight belong to the day they start
+		{window: "oncall@sun/22:00-06:00/UTC", t: monday(5, 0), want: true},
+		{window: "oncall@sun/22:00-06:00/UTC", t: monday(22, 0), want: false},
+		{window: "oncall@mon/22:00-06:00/UTC", t: monday(23, 0), want: true},
+		{window: "oncall@mon/22:00-06:00/UTC", t: monday(5, 0), want: false},
+		{window: "oncall@*/22:00-06:00/UTC", t: monday(12, 0), want: false},
+	}
+
+	for _, tc := range cases {
+		w, err := parseTimeWindow(tc.window)
+		if err != nil {
+			t.Fatalf("parseTimeWindow(%q): %v", tc.window, err)
+		}
+
+		if got := w.Contains(tc.t); got != tc.want {
+			t.Errorf("%q contains %v: want %t, got %t", tc.window, tc.t.In(newYork), tc.want, got)
+		}
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	cases := []struct {
+		window  string
+		wantErr string
+	}{
+		{window: "oncall@mon-fri/09:00-17:00"},
+		{window: "eng@example.com@*/09:00-17:00/UTC"},
+		{window: "mon-fri/09:00-17:00", wantErr: "expected <group>@<days>/<start>-<end>"},
+		{window: "oncall@mon-fri", wantErr: "expected <group>@<days>/<start>-<end>"},
+		{window: "oncall@someday/09:00-17:00", wantErr: "unknown day: someday"},
+		{window: "oncall@mon/09:00", wantErr: "expected <start>-<end>"},
+		{window: "oncall@mon/9am-5pm", wantErr: "invalid time of day: 9am"},
+		{window: "oncall@mon/09:00-09:00", wantErr: "empty hours"},
+		{window: "oncall@mon/09:00-17:00/Mars/Olympus_Mons", wantErr: "unknown time zone"},
+	}
+
+	for _, tc := range cases {
+		_, err := parseTimeWindow(tc.window)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%q: want no err, got %v", tc.window, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: want err %v, got %v", tc.window, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%q: want err %v, got none", tc.window, tc.wantErr)
+		}
+	}
+}
+
+func TestAuthorizeTime(t *testing.T) {
+	// Monday 2021-06-07 12:00 UTC
+	now := time.Date(2021, 6, 7, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name               string
+		extra              map[string]interface{}
+		groupHours         []string
+		accessStartsClaim  string
+		accessExpiresClaim string
+		wantErr            string
+		wantExpired        bool
+	}{
+		{
+			name:       "unrestricted group",
+			extra:      map[string]interface{}{"groups": []interface{}{"engineering"}},
+			groupHours: []string{"contractors@mon-fri/09:00-11:00/UTC"},
+		},
+		{
+			name:       "restricted group within hours",
+			extra:      map[string]interface{}{"groups": []interface{}{"engineering", "contractors"}},
+			groupHours: []string{"contractors@mon-fri/09:00-17:00/UTC"},
+		},
+		{
+			name:       "restricted group outside hours",
+			extra:      map[string]interface{}{"groups": []interface{}{"engineering", "contractors"}},
+			groupHours: []string{"contractors@mon-fri/09:00-11:00/UTC"},
+			wantErr:    `it is Mon 12:00 UTC, which is not within hours [contractors@mon-fri/09:00-11:00/UTC] of group "contractors"`,
+		},
+		{
+			name:       "restricted group within second window",
+			extra:      map[string]interface{}{"groups": []interface{}{"oncall"}},
+			groupHours: []string{"oncall@mon-fri/09:00-11:00/UTC", "oncall@mon/11:00-13:00/UTC"},
+		},
+		{
+			name:       "each restricted group",
+			extra:      map[string]interface{}{"groups": []interface{}{"oncall", "contractors"}},
+			groupHours: []string{"oncall@*/00:00-24:00/UTC", "contractors@sat+sun/00:00-24:00/UTC"},
+			wantErr:    `of group "contractors"`,
+		},
+		{
+			name:               "access window",
+			extra:              map[string]interface{}{"access_starts_at": now.Add(-time.Hour).Unix(), "access_expires_at": now.Add(time.Hour).Unix()},
+			accessStartsClaim:  "access_starts_at",
+			accessExpiresClaim: "access_expires_at",
+		},
+		{
+			name:               "access expired",
+			extra:              map[string]interface{}{"access_expires_at": now.Add(-time.Minute).Unix()},
+			accessExpiresClaim: "access_expires_at",
+			wantErr:            "account expired: access expired at 2021-06-07 11:59:00 +0000 UTC",
+			wantExpired:        true,
+		},
+		{
+			name:              "access not started",
+			extra:             map[string]interface{}{"access_starts_at": now.Add(time.Minute).Unix()},
+			accessStartsClaim: "access_starts_at",
+			wantErr:           "access starts at 2021-06-07 12:01:00 +0000 UTC",
+		},
+		{
+			name:               "nested RFC 3339 access expiry",
+			extra:              map[string]interface{}{"jit": map[string]interface{}{"expires": "2021-06-07T13:00:00Z"}},
+			accessExpiresClaim: "jit.expires",
+		},
+		{
+			name:               "malformed access expiry",
+			extra:              map[string]interface{}{"access_expires_at": "tomorrow"},
+			accessExpiresClaim: "access_expires_at",
+			wantErr:            `claim access_expires_at is "tomorrow", which is not a time`,
+		},
+		{
+			name:               "absent access expiry",
+			accessExpiresClaim: "access_expires_at",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &authenticator{
+				clock: func() time.Time { return now },
+			}
+			auth.GroupHours = tc.groupHours
+			auth.AccessStartsClaim = tc.accessStartsClaim
+			auth.AccessExpiresClaim = tc.accessExpiresClaim
+
+			err := auth.authorize(&oidc.Claims{Subject: "jdoe", Extra: tc.extra})
+			if err != nil && tc.wantErr == "" {
+				t.Fatalf("want no err, got %v", err)
+			} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			} else if err == nil && tc.wantErr != "" {
+				t.Fatalf("want err %v, got none", tc.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, ErrTimeDenied) {
+				t.Errorf("want errors.Is(err, ErrTimeDenied), got %v", err)
+			}
+			if code := accountCode(err); err != nil && tc.wantExpired && code != pamAcctExpired {
+				t.Errorf("want account code %v, got %v", pamAcctExpired, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pardot/oidc"
+)
+
+// userMap maps token identities to the local users they may authenticate as,
+// from a file of the form:
+//
+//	# Selectors, followed by a comma-separated list of users
+//	iss=https://example.okta.com sub=00u1abcd  jdoe,deploy
+//	email=jane@example.com                      jane
+//
+// An entry applies to a token if all of its selectors match: `iss` and `sub`
+// match the issuer and subject, and `email` matches the email claim, ignoring
+// case, only if the email_verified claim is true. Subjects are only unique
+// within an issuer, so `sub` requires `iss`.
+//
+// The file is parsed again when it is modified. Because it grants access, the
+// file must be owned by the current user or root, and must not be writable by
+// others.
+type userMap struct {
+	path string
+}
+
+// userMapEntry is a single entry of a user map.
+type userMapEntry struct {
+	// line is the line number of the entry, for logging.
+	line    int
+	issuer  string
+	subject string
+	email   string
+	users   []string
+}
+
+// userMapFile is a parsed user map, and the file info it was parsed from.
+type userMapFile struct {
+	modTime time.Time
+	size    int64
+	entries []userMapEntry
+}
+
+// userMapCache caches parsed user maps by path, so they are only parsed again
+// when modified.
+var userMapCache = struct {
+	sync.Mutex
+	files map[string]*userMapFile
+}{
+	files: make(map[string]*userMapFile),
+}
+
+func newUserMap(path string) *userMap {
+	return &userMap{path: path}
+}
+
+// Lookup returns the entries that apply to claims.
+func (m *userMap) Lookup(claims *oidc.Claims) ([]userMapEntry, error) {
+	entries, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Some issuers let users change their email without verifying it, and
+	// omit email_verified, so an email is only trusted if marked verified.
+	email, _ := claims.Extra["email"].(string)
+	if verified, _ := claims.Extra["email_verified"].(bool); !verified {
+		email = ""
+	}
+
+	var matched []userMapEntry
+	for _, e := range entries {
+		if e.issuer != "" && e.issuer != claims.Issuer {
+			continue
+		}
+		if e.subject != "" && e.subject != claims.Subject {
+			continue
+		}
+		if e.email != "" && (email == "" || !strings.EqualFold(e.email, email)) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+
+	return matched, nil
+}
+
+// load returns the entries of the user map, parsing the file if it was
+// modified since it was last parsed.
+func (m *userMap) load() ([]userMapEntry, error) {
+	userMapCache.Lock()
+	defer userMapCache.Unlock()
+
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("opening user map: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("opening user map: %v", err)
+	} else if err := checkOwnership(m.path, fi); err != nil {
+		return nil, err
+	}
+
+	if cached, ok := userMapCache.files[m.path]; ok && cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.entries, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("reading user map: %v", err)
+	}
+
+	entries, err := parseUserMap(m.path, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	userMapCache.files[m.path] = &userMapFile{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		entries: entries,
+	}
+
+	return entries, nil
+}
+
+// parseUserMap parses the user map in data, read from path.
+func parseUserMap(path string, data []byte) ([]userMapEntry, error) {
+	var entries []userMapEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected selectors followed by users", path, n)
+		}
+
+		e := userMapEntry{line: n}
+		for _, field := range fields[:len(fields)-1] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, fmt.Errorf("%s:%d: malformed selector: %v", path, n, field)
+			}
+
+			switch parts[0] {
+			case "iss":
+				e.issuer = parts[1]
+			case "sub":
+				e.subject = parts[1]
+			case "email":
+				e.email = parts[1]
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown selector: %v", path, n, parts[0])
+			}
+		}
+
+		if e.subject != "" && e.issuer == "" {
+			return nil, fmt.Errorf("%s:%d: sub requires iss", path, n)
+		}
+
+		for _, user := range strings.Split(fields[len(fields)-1], ",") {
+			if user == "" || strings.Contains(user, "=") {
+				return nil, fmt.Errorf("%s:%d: malformed users: %v", path, n, fields[len(fields)-1])
+			}
+			e.users = append(e.users, user)
+		}
+
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading user map: %v", err)
+	}
+
+	return entries, nil
+}
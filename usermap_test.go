@@ -0,0 +1,203 @@
+// Copyright (c) 2021, salesforce.com, inc.
+// All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+// For full license text, see the LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pardot/oidc"
+)
+
+const testUserMap = `
+# Legacy accounts
+iss=https://example.okta.com sub=00u1abcd   jdoe,deploy
+iss=https://example.okta.com sub=00u2efgh   svc_backup
+
+# Any trusted issuer
+email=Jane@Example.com                      jane
+`
+
+func TestUserMapLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(testUserMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := newUserMap(path)
+
+	cases := []struct {
+		name      string
+		claims    *oidc.Claims
+		wantUsers []string
+	}{
+		{
+			name:      "issuer and subject",
+			claims:    &oidc.Claims{Issuer: "https://example.okta.com", Subject: "00u1abcd"},
+			wantUsers: []string{"jdoe", "deploy"},
+		},
+		{
+			name:   "subject from another issuer",
+			claims: &oidc.Claims{Issuer: "https://accounts.google.com", Subject: "00u1abcd"},
+		},
+		{
+			name: "email ignoring case",
+			claims: &oidc.Claims{
+				Issuer:  "https://accounts.google.com",
+				Subject: "110169484474386276334",
+				Extra:   map[string]interface{}{"email": "jane@example.com", "email_verified": true},
+			},
+			wantUsers: []string{"jane"},
+		},
+		{
+			name: "unverified email",
+			claims: &oidc.Claims{
+				Issuer:  "https://accounts.google.com",
+				Subject: "110169484474386276334",
+				Extra:   map[string]interface{}{"email": "jane@example.com", "email_verified": false},
+			},
+		},
+		{
+			name: "email without email_verified",
+			claims: &oidc.Claims{
+				Issuer:  "https://login.microsoftonline.com/tenant/v2.0",
+				Subject: "AAAAAAAAAAAAAAAAAAAAAIkzqFVrSaSaFHy782bbtaQ",
+				Extra:   map[string]interface{}{"email": "jane@example.com"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := m.Lookup(tc.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var users []string
+			for _, e := range entries {
+				users = append(users, e.users...)
+			}
+			if diff := cmp.Diff(tc.wantUsers, users); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestUserMapReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("email=jane@example.com jane\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := newUserMap(path)
+	claims := &oidc.Claims{Extra: map[string]interface{}{"email": "jane@example.com", "email_verified": true}}
+
+	entries, err := m.Lookup(claims)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].users[0] != "jane" {
+		t.Fatalf("want jane, got %v", entries)
+	}
+
+	if err := os.WriteFile(path, []byte("email=jane@example.com jdoe\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Ensure the modification time changes, even on coarse filesystems
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = m.Lookup(claims)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].users[0] != "jdoe" {
+		t.Errorf("want reloaded jdoe, got %v", entries)
+	}
+}
+
+func TestParseUserMap(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "valid", data: testUserMap},
+		{name: "missing users", data: "iss=https://example.com\n", wantErr: "users:1: expected selectors followed by users"},
+		{name: "missing selectors", data: "\njdoe\n", wantErr: "users:2: expected selectors followed by users"},
+		{name: "unknown selector", data: "name=jdoe jdoe\n", wantErr: "users:1: unknown selector: name"},
+		{name: "empty selector", data: "email= jdoe\n", wantErr: "users:1: malformed selector: email="},
+		{name: "subject without issuer", data: "sub=00u1abcd jdoe\n", wantErr: "users:1: sub requires iss"},
+		{name: "malformed users", data: "email=jane@example.com jane,,jdoe\n", wantErr: "users:1: malformed users"},
+	}
+
+	for _, tc := range cases {
+		_, err := parseUserMap("users", []byte(tc.data))
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%s: want no err, got %v", tc.name, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: want err %v, got %v", tc.name, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%s: want err %v, got none", tc.name, tc.wantErr)
+		}
+	}
+}
+
+func TestUserMapPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(testUserMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newUserMap(path).Lookup(&oidc.Claims{}); err == nil || !strings.Contains(err.Error(), "must not be writable by group or others") {
+		t.Errorf("want permission err, got %v", err)
+	}
+}
+
+func TestCheckUserWithUserMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(testUserMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &oidc.Claims{Issuer: "https://example.okta.com", Subject: "00u1abcd"}
+
+	cases := []struct {
+		name        string
+		user        string
+		userMapOnly bool
+		wantErr     string
+	}{
+		{name: "mapped user", user: "deploy"},
+		{name: "user from template", user: "00u1abcd"},
+		{name: "user from template with user map only", user: "00u1abcd", userMapOnly: true, wantErr: `user "00u1abcd" is not listed for the token in user map`},
+		{name: "unmapped user", user: "root", wantErr: `expected user "00u1abcd" but is authenticating as "root"`},
+	}
+
+	for _, tc := range cases {
+		auth := &authenticator{
+			UserMap:     newUserMap(path),
+			UserMapOnly: tc.userMapOnly,
+		}
+
+		err := auth.checkUser(tc.user, claims)
+		if err != nil && tc.wantErr == "" {
+			t.Errorf("%s: want no err, got %v", tc.name, err)
+		} else if err != nil && !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: want err %v, got %v", tc.name, tc.wantErr, err)
+		} else if err == nil && tc.wantErr != "" {
+			t.Errorf("%s: want err %v, got none", tc.name, tc.wantErr)
+		}
+	}
+}